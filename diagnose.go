@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli/v3"
+
+	"github.com/cosineblast/pumpsync/internal/mediasync"
+	"github.com/cosineblast/pumpsync/internal/video_store"
+)
+
+func locateCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "locate",
+		Usage:     "find where the audio of a media file plays in another one",
+		ArgsUsage: "<haystack> <needle>",
+		Action:    runLocate,
+	}
+}
+
+func focusCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "focus",
+		Usage:     "detect the start and end of music delimiters in a chart video",
+		ArgsUsage: "<chart video>",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"o"},
+				Usage:   "also write the trimmed chart audio to this path",
+			},
+		},
+		Action: runFocus,
+	}
+}
+
+type locateOutput struct {
+	Offset      float64        `json:"offset"`
+	Score       float64        `json:"score"`
+	Diagnostics map[string]any `json:"diagnostics"`
+}
+
+type focusAttempt struct {
+	StartScore float64 `json:"start_score"`
+	EndScore   float64 `json:"end_score"`
+}
+
+type focusOutput struct {
+	Matched  bool                    `json:"matched"`
+	Match    *mediasync.FocusSuccess `json:"match,omitempty"`
+	Attempts map[string]focusAttempt `json:"attempts,omitempty"`
+	Output   string                  `json:"output,omitempty"`
+}
+
+var MissingArgumentsError = errors.New("missing arguments")
+
+func runLocate(ctx context.Context, cmd *cli.Command) error {
+	if cmd.Args().Len() != 2 {
+		return fmt.Errorf("[%w] expected <haystack> <needle>", MissingArgumentsError)
+	}
+
+	cfg, err := loadConfig(cmd)
+
+	if err != nil {
+		return err
+	}
+
+	locator, err := newLocator(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	haystack, err := mediasync.ExtractAudio(ctx, cmd.Args().Get(0))
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(haystack)
+
+	needle, err := mediasync.ExtractAudio(ctx, cmd.Args().Get(1))
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(needle)
+
+	result, err := mediasync.LocateAudio(ctx, locator, haystack, needle)
+
+	if err != nil {
+		return err
+	}
+
+	return printJSON(locateOutput{result.Offset, result.Score, result.Diagnostics})
+}
+
+func runFocus(ctx context.Context, cmd *cli.Command) error {
+	if cmd.Args().Len() != 1 {
+		return fmt.Errorf("[%w] expected <chart video>", MissingArgumentsError)
+	}
+
+	cfg, err := loadConfig(cmd)
+
+	if err != nil {
+		return err
+	}
+
+	locator, err := newLocator(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	delimiters, err := loadDelimiters(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	audio, err := mediasync.ExtractAudio(ctx, cmd.Args().Get(0))
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(audio)
+
+	var output focusOutput
+
+	match, err := mediasync.FocusAudio(ctx, audio, locator, delimiters, cfg.FocusWorkers)
+
+	var focusFail mediasync.FocusFail
+
+	if errors.As(err, &focusFail) {
+		output.Attempts = make(map[string]focusAttempt)
+
+		for key, scores := range focusFail.Attempts {
+			output.Attempts[key] = focusAttempt{scores.Left, scores.Right}
+		}
+	} else if err != nil {
+		return err
+	} else {
+		output.Matched = true
+		output.Match = match
+	}
+
+	if path := cmd.String("output"); path != "" {
+		trimmed, err := mediasync.TrimFocusedAudio(ctx, audio, match)
+
+		if err != nil {
+			return err
+		}
+
+		err = video_store.MoveFile(trimmed, path)
+
+		if err != nil {
+			os.Remove(trimmed)
+			return err
+		}
+
+		output.Output = path
+	}
+
+	return printJSON(output)
+}
+
+func printJSON(value any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(value)
+}
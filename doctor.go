@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v3"
+
+	"github.com/cosineblast/pumpsync/internal/config"
+	"github.com/cosineblast/pumpsync/internal/health"
+	"github.com/cosineblast/pumpsync/internal/video_store"
+)
+
+func doctorCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "doctor",
+		Usage: "check the programs, delimiters, temporary directory and video store the edits depend on",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "print the report as json, like /readyz",
+			},
+		},
+		Action: runDoctor,
+	}
+}
+
+var FailedChecksError = errors.New("some checks failed")
+
+func runDoctor(ctx context.Context, cmd *cli.Command) error {
+	cfg, err := loadConfig(cmd)
+
+	if err != nil {
+		return err
+	}
+
+	checkStore, err := storeCheck(cfg)
+
+	if err != nil {
+		return fmt.Errorf("failed to open the video store: %w", err)
+	}
+
+	report := health.NewChecker(cfg, checkStore).Run(ctx)
+
+	if cmd.Bool("json") {
+		err = printJSON(report)
+	} else {
+		err = printReport(report)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !report.Ok {
+		return FailedChecksError
+	}
+
+	return nil
+}
+
+// A server may be using the store, so a filesystem store is only checked, since opening it
+// removes the results which aren't in its index. Opening an s3 store doesn't touch the bucket.
+func storeCheck(cfg *config.Config) (func(ctx context.Context) error, error) {
+
+	if cfg.Store == "s3" {
+		store, err := video_store.NewS3Store(cfg.S3, cfg.ResultTTL)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return store.CheckWritable, nil
+	}
+
+	return func(ctx context.Context) error { return video_store.CheckDirWritable(cfg.StoreDir) }, nil
+}
+
+func printReport(report health.Report) error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	for _, check := range report.Checks {
+		status := "ok"
+
+		if !check.Ok {
+			status = "FAIL"
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", status, check.Name, check.Detail)
+	}
+
+	return writer.Flush()
+}
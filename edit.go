@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/urfave/cli/v3"
+
+	"github.com/cosineblast/pumpsync/internal/mediasync"
+	"github.com/cosineblast/pumpsync/internal/video_store"
+)
+
+func editCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "edit",
+		Usage: "replace the audio of a local gameplay video with the audio of a youtube chart video",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "gameplay",
+				Usage:    "path of the gameplay video",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "youtube",
+				Usage:    "id or url of the youtube video with the chart audio",
+				Required: true,
+			},
+			&cli.BoolFlag{
+				Name:  "overlay",
+				Usage: "also show the chart video on top of the gameplay video",
+			},
+			&cli.StringFlag{
+				Name:  "overlay-position",
+				Usage: "corner of the chart video: top_left, top_right, bottom_left or bottom_right",
+				Value: mediasync.DefaultOverlayOptions.Position,
+			},
+			&cli.FloatFlag{
+				Name:  "overlay-scale",
+				Usage: "width of the chart video relative to the gameplay video",
+				Value: mediasync.DefaultOverlayOptions.Scale,
+			},
+			&cli.FloatFlag{
+				Name:  "overlay-opacity",
+				Usage: "opacity of the chart video",
+				Value: mediasync.DefaultOverlayOptions.Opacity,
+			},
+			&cli.StringFlag{
+				Name:  "audio-only",
+				Usage: "only write the synced audio, with the given format: m4a, flac or wav",
+			},
+			&cli.StringFlag{
+				Name:     "output",
+				Aliases:  []string{"o"},
+				Usage:    "path where the edited video (or audio) will be written",
+				Required: true,
+			},
+		},
+		Action: runEdit,
+	}
+}
+
+func runEdit(ctx context.Context, cmd *cli.Command) error {
+	cfg, err := loadConfig(cmd)
+
+	if err != nil {
+		return err
+	}
+
+	locator, err := newLocator(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	delimiters, err := loadDelimiters(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	cache, err := newYoutubeCache(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	options := mediasync.Options{
+		Locator:      locator,
+		Delimiters:   delimiters,
+		FocusWorkers: cfg.FocusWorkers,
+		MinimumScore: cfg.MinimumScore,
+		Cache:        cache,
+		Progress:     printProgress,
+	}
+
+	if format := cmd.String("audio-only"); format != "" {
+		options.Kind = mediasync.KindOverwriteAudio
+		options.AudioFormat = mediasync.AudioFormat(format)
+	} else if cmd.Bool("overlay") {
+		options.Kind = mediasync.KindOverlayVideo
+		options.Overlay = mediasync.OverlayOptions{
+			Position: cmd.String("overlay-position"),
+			Scale:    cmd.Float("overlay-scale"),
+			Opacity:  cmd.Float("overlay-opacity"),
+		}
+	}
+
+	gameplay, err := mediasync.ValidateGameplayVideo(ctx, cmd.String("gameplay"), cfg.MaxGameplayDuration)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("gameplay video: %s, %.0f seconds\n", gameplay.Container, gameplay.Duration)
+
+	link := youtubeLink(cmd.String("youtube"))
+
+	info, err := mediasync.PreflightYoutubeVideo(ctx, link, cfg.MaxYoutubeDuration)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("youtube video: %s (%.0f seconds)\n", info.Title, info.Duration)
+
+	result, err := mediasync.ImproveAudio(ctx, cmd.String("gameplay"), link, options)
+
+	if err != nil {
+		return err
+	}
+
+	if result.Match != nil {
+		fmt.Printf("delimiter: %s (start score %f, end score %f)\n",
+			result.Match.Identifier, result.Match.StartScore, result.Match.EndScore)
+	} else {
+		fmt.Println("delimiter: none matched, used silence removal")
+	}
+
+	fmt.Printf("offset: %f (score %f)\n", result.Offset, result.Score)
+
+	output := cmd.String("output")
+
+	err = video_store.MoveFile(result.Path, output)
+
+	if err != nil {
+		os.Remove(result.Path)
+		return err
+	}
+
+	fmt.Println("result written to", output)
+
+	return nil
+}
+
+func printProgress(event mediasync.ProgressEvent) {
+	if event.Delimiter != "" {
+		fmt.Fprintf(os.Stderr, "[%s] matched delimiter: %s\n", event.Stage, event.Delimiter)
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "[%s] elapsed %s, about %s left\n",
+		event.Stage, event.Elapsed.Round(time.Second), event.ETA.Round(time.Second))
+}
+
+var youtubeIdRegex = regexp.MustCompile(`^[a-zA-Z0-9\-\_]+$`)
+
+// accepts either a video id or a full url
+func youtubeLink(video string) string {
+	if youtubeIdRegex.MatchString(video) {
+		return fmt.Sprintf("http://youtube.com/watch?v=%s", video)
+	}
+
+	return video
+}
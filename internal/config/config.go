@@ -0,0 +1,446 @@
+package config
+
+// Settings are read from (in increasing order of priority):
+// their default values, the config file (a json object with the settings as keys),
+// environment variables (PUMPSYNC_ followed by the setting in upper case, also read from .env)
+// and command line flags (the setting with dashes instead of underscores).
+// Empty variables are ignored, settings which can be disabled accept "off" instead.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/urfave/cli/v3"
+
+	"github.com/cosineblast/pumpsync/internal/links"
+	"github.com/cosineblast/pumpsync/internal/mediasync"
+	"github.com/cosineblast/pumpsync/internal/video_store"
+)
+
+type Config struct {
+	Host      string
+	Port      int
+	UrlPrefix string // used when generating links to this server (e.g video download links)
+
+	UseTLS  bool
+	TLSCert string
+	TLSKey  string
+
+	Debug     bool   // logs at debug level, which includes the stderr of the commands we run
+	LogFormat string // text || json
+
+	// websites allowed to use this server from the browser, "*" allows every website
+	AllowedOrigins []string
+
+	Locator     string // native || external || python
+	LocatorPath string
+
+	Workers    int
+	MaxQueued  int
+	JobTimeout time.Duration
+
+	YoutubeCacheDir   string // the cache is disabled when empty
+	YoutubeCacheBytes int64
+
+	MaxUploadBytes      int64
+	MaxGameplayDuration time.Duration
+	MaxYoutubeDuration  time.Duration
+
+	Delimiters   string  // path of the delimiters manifest
+	FocusWorkers int     // how many delimiters are located at the same time
+	MinimumScore float64 // of the music in the gameplay video
+
+	Store     string // filesystem || s3
+	StoreDir  string // where the results are kept until they expire, in the filesystem store
+	ResultTTL time.Duration
+
+	S3 video_store.S3Config
+
+	LinkKeys         []links.Key // the first one signs download links, a random one is used when empty
+	LinkMaxDownloads int         // 0 for no limit
+
+	RatingsFile string // where user ratings of the results are appended to
+}
+
+type setting struct {
+	key          string
+	defaultValue string
+	usage        string
+	apply        func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{"host", "", "the host the server will listen on", stringValue(func(c *Config) *string { return &c.Host })},
+	{"port", "8000", "the port the server will listen on", intValue(func(c *Config) *int { return &c.Port })},
+	{"url_prefix", "http://127.0.0.1:8000", "the prefix of the links to this server", urlValue(func(c *Config) *string { return &c.UrlPrefix })},
+
+	{"use_tls", "false", "accept TLS connections", boolValue(func(c *Config) *bool { return &c.UseTLS })},
+	{"tls_cert", "", "path of the TLS certificate", stringValue(func(c *Config) *string { return &c.TLSCert })},
+	{"tls_key", "", "path of the TLS certificate key", stringValue(func(c *Config) *string { return &c.TLSKey })},
+
+	{"debug", "false", "log debug messages, including the stderr of the commands the server runs", boolValue(func(c *Config) *bool { return &c.Debug })},
+	{"log_format", "text", "the format of the logs: text or json", stringValue(func(c *Config) *string { return &c.LogFormat })},
+
+	{"allowed_origins", "", "comma separated origins (e.g https://example.com) allowed to use the server from the browser, * allows every origin",
+		originsValue(func(c *Config) *[]string { return &c.AllowedOrigins })},
+
+	{"locator", "native", "the audio locator: native, external or python", stringValue(func(c *Config) *string { return &c.Locator })},
+	{"locator_path", "", "the program or script used by the locator", stringValue(func(c *Config) *string { return &c.LocatorPath })},
+
+	{"workers", "1", "how many edit jobs run at the same time", intValue(func(c *Config) *int { return &c.Workers })},
+	{"max_queued", "32", "how many edit jobs can wait in the queue", intValue(func(c *Config) *int { return &c.MaxQueued })},
+	{"job_timeout", "15m", "how long an edit job may run", durationValue(func(c *Config) *time.Duration { return &c.JobTimeout })},
+
+	{"youtube_cache_dir", "", "where downloaded youtube videos are cached, disabled if empty or off", optionalValue(func(c *Config) *string { return &c.YoutubeCacheDir })},
+	{"youtube_cache_mb", "4096", "how many megabytes the youtube cache may use", megabytesValue(func(c *Config) *int64 { return &c.YoutubeCacheBytes })},
+
+	{"max_upload_mb", "500", "the maximum size of uploaded gameplay videos, in megabytes", megabytesValue(func(c *Config) *int64 { return &c.MaxUploadBytes })},
+	{"max_gameplay_duration", mediasync.MAX_GAMEPLAY_DURATION.String(), "the maximum duration of gameplay videos", durationValue(func(c *Config) *time.Duration { return &c.MaxGameplayDuration })},
+	{"max_youtube_duration", mediasync.MAX_YOUTUBE_DURATION.String(), "the maximum duration of youtube chart videos", durationValue(func(c *Config) *time.Duration { return &c.MaxYoutubeDuration })},
+
+	{"delimiters", mediasync.DefaultDelimitersPath, "the manifest of the game delimiter packs", stringValue(func(c *Config) *string { return &c.Delimiters })},
+	{"focus_workers", fmt.Sprint(mediasync.DEFAULT_FOCUS_WORKERS), "how many game delimiters are located at the same time in each edit",
+		intValue(func(c *Config) *int { return &c.FocusWorkers })},
+	{"final_score", fmt.Sprint(mediasync.MINIMUM_FINAL_MATCH_SCORE), "the minimum score of the music in the gameplay video",
+		floatValue(func(c *Config) *float64 { return &c.MinimumScore })},
+
+	{"store_dir", "results", "the directory where results are kept until they expire", stringValue(func(c *Config) *string { return &c.StoreDir })},
+	{"result_ttl", video_store.DEFAULT_TTL.String(), "how long results can be downloaded", durationValue(func(c *Config) *time.Duration { return &c.ResultTTL })},
+	{"store", "filesystem", "where results are kept: filesystem or s3", stringValue(func(c *Config) *string { return &c.Store })},
+
+	{"s3_endpoint", "", "the url of the s3 compatible service", stringValue(func(c *Config) *string { return &c.S3.Endpoint })},
+	{"s3_region", "us-east-1", "the region of the s3 bucket", stringValue(func(c *Config) *string { return &c.S3.Region })},
+	{"s3_bucket", "", "the bucket where results are kept", stringValue(func(c *Config) *string { return &c.S3.Bucket })},
+	{"s3_prefix", "results/", "the prefix of the result objects in the bucket", stringValue(func(c *Config) *string { return &c.S3.Prefix })},
+	{"s3_access_key", "", "the access key id of the s3 bucket", stringValue(func(c *Config) *string { return &c.S3.AccessKey })},
+	{"s3_secret_key", "", "the secret access key of the s3 bucket", stringValue(func(c *Config) *string { return &c.S3.SecretKey })},
+	{"s3_redirect", "false", "redirect downloads to presigned s3 urls instead of streaming them", boolValue(func(c *Config) *bool { return &c.S3.Redirect })},
+	{"s3_lifecycle", "false", "expired results are removed by a lifecycle rule of the bucket", boolValue(func(c *Config) *bool { return &c.S3.Lifecycle })},
+
+	{"link_keys", "", "comma separated <id>:<secret> keys signing download links, the first one signs new links",
+		keysValue(func(c *Config) *[]links.Key { return &c.LinkKeys })},
+	{"link_max_downloads", "0", "how many times each download link can be used, 0 for no limit",
+		countValue(func(c *Config) *int { return &c.LinkMaxDownloads })},
+
+	{"ratings_file", "ratings.jsonl", "the file where user ratings of the results are stored", stringValue(func(c *Config) *string { return &c.RatingsFile })},
+}
+
+func (s *setting) envName() string {
+	return "PUMPSYNC_" + strings.ToUpper(s.key)
+}
+
+func (s *setting) flagName() string {
+	return strings.ReplaceAll(s.key, "_", "-")
+}
+
+var InvalidConfigError = errors.New("invalid config")
+
+// The command line flags of every setting, plus --config, meant to be added to the root command.
+func Flags() []cli.Flag {
+	flags := []cli.Flag{
+		&cli.StringFlag{
+			Name:  "config",
+			Usage: "path of a json config file (also PUMPSYNC_CONFIG)",
+		},
+	}
+
+	for _, s := range settings {
+		usage := fmt.Sprintf("%s (%s)", s.usage, s.envName())
+
+		if s.defaultValue != "" {
+			usage = fmt.Sprintf("%s (default: %s) (%s)", s.usage, s.defaultValue, s.envName())
+		}
+
+		flags = append(flags, &cli.StringFlag{Name: s.flagName(), Usage: usage})
+	}
+
+	return flags
+}
+
+// Loads the configuration from every source, cmd must be a command with the flags from Flags (or one of its subcommands).
+func Load(cmd *cli.Command) (*Config, error) {
+
+	err := godotenv.Load()
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to load .env: %w", err)
+	}
+
+	values := make(map[string]string)
+
+	for _, s := range settings {
+		values[s.key] = s.defaultValue
+	}
+
+	path := cmd.String("config")
+
+	if path == "" {
+		path = os.Getenv("PUMPSYNC_CONFIG")
+	}
+
+	if path != "" {
+		if err := readFile(path, values); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		// e.g PUMPSYNC_PORT= in a compose file means the variable isn't set
+		if value := os.Getenv(s.envName()); value != "" {
+			values[s.key] = value
+		}
+
+		if cmd.IsSet(s.flagName()) {
+			values[s.key] = cmd.String(s.flagName())
+		}
+	}
+
+	var config Config
+
+	for _, s := range settings {
+		if err := s.apply(&config, values[s.key]); err != nil {
+			return nil, fmt.Errorf("[%w] %s: %w", InvalidConfigError, s.key, err)
+		}
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("[%w] %w", InvalidConfigError, err)
+	}
+
+	return &config, nil
+}
+
+func readFile(path string, values map[string]string) error {
+
+	content, err := os.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+
+	var file map[string]any
+
+	if err = decoder.Decode(&file); err != nil {
+		return fmt.Errorf("[%w] %s: %w", InvalidConfigError, path, err)
+	}
+
+	for key, value := range file {
+		if _, ok := values[key]; !ok {
+			return fmt.Errorf("[%w] %s: unknown setting %q", InvalidConfigError, path, key)
+		}
+
+		switch value.(type) {
+		case string, json.Number, bool:
+			values[key] = fmt.Sprint(value)
+		default:
+			return fmt.Errorf("[%w] %s: %s must be a string, number or boolean", InvalidConfigError, path, key)
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) validate() error {
+
+	if c.Port > 65535 {
+		return fmt.Errorf("port must be at most 65535, got %d", c.Port)
+	}
+
+	if c.UseTLS && (c.TLSCert == "" || c.TLSKey == "") {
+		return errors.New("tls_cert and tls_key must be set when use_tls is enabled")
+	}
+
+	switch c.LogFormat {
+	case "text", "json":
+	default:
+		return fmt.Errorf("unknown log format %q", c.LogFormat)
+	}
+
+	switch c.Locator {
+	case "native", "external", "python":
+	default:
+		return fmt.Errorf("unknown locator %q", c.Locator)
+	}
+
+	switch c.Store {
+	case "filesystem":
+	case "s3":
+		if c.S3.Endpoint == "" || c.S3.Bucket == "" || c.S3.AccessKey == "" || c.S3.SecretKey == "" {
+			return errors.New("s3_endpoint, s3_bucket, s3_access_key and s3_secret_key must be set when store is s3")
+		}
+
+		// the janitor removes every expired object with the prefix
+		if c.S3.Prefix == "" {
+			return errors.New("s3_prefix must not be empty, or every object in the bucket would be removed once it is older than result_ttl")
+		}
+	default:
+		return fmt.Errorf("unknown store %q", c.Store)
+	}
+
+	return nil
+}
+
+func stringValue(field func(*Config) *string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+// a string which is disabled by an empty value or "off"
+func optionalValue(field func(*Config) *string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		if value == "off" {
+			value = ""
+		}
+
+		*field(c) = value
+		return nil
+	}
+}
+
+func urlValue(field func(*Config) *string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		parsed, err := url.Parse(value)
+
+		if err != nil {
+			return err
+		}
+
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return fmt.Errorf("expected an http or https url, got %q", value)
+		}
+
+		*field(c) = strings.TrimSuffix(value, "/")
+		return nil
+	}
+}
+
+func originsValue(field func(*Config) *[]string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		var origins []string
+
+		for _, origin := range strings.Split(value, ",") {
+			origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+
+			if origin == "" {
+				continue
+			}
+
+			if origin != "*" {
+				parsed, err := url.Parse(origin)
+
+				if err != nil || parsed.Scheme == "" || parsed.Host == "" || parsed.Path != "" {
+					return fmt.Errorf("expected origins like https://example.com, got %q", origin)
+				}
+			}
+
+			origins = append(origins, origin)
+		}
+
+		*field(c) = origins
+		return nil
+	}
+}
+
+func boolValue(field func(*Config) *bool) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		result, err := strconv.ParseBool(value)
+
+		if err != nil {
+			return fmt.Errorf("expected a boolean (e.g 1 or true), got %q", value)
+		}
+
+		*field(c) = result
+		return nil
+	}
+}
+
+func intValue(field func(*Config) *int) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		result, err := strconv.Atoi(value)
+
+		if err != nil || result <= 0 {
+			return fmt.Errorf("expected a positive integer, got %q", value)
+		}
+
+		*field(c) = result
+		return nil
+	}
+}
+
+func countValue(field func(*Config) *int) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		result, err := strconv.Atoi(value)
+
+		if err != nil || result < 0 {
+			return fmt.Errorf("expected a non negative integer, got %q", value)
+		}
+
+		*field(c) = result
+		return nil
+	}
+}
+
+func keysValue(field func(*Config) *[]links.Key) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		keys, err := links.ParseKeys(value)
+
+		if err != nil {
+			return err
+		}
+
+		*field(c) = keys
+		return nil
+	}
+}
+
+func megabytesValue(field func(*Config) *int64) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		result, err := strconv.ParseInt(value, 10, 64)
+
+		if err != nil || result <= 0 {
+			return fmt.Errorf("expected a positive integer, got %q", value)
+		}
+
+		*field(c) = result * 1024 * 1024
+		return nil
+	}
+}
+
+func floatValue(field func(*Config) *float64) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		result, err := strconv.ParseFloat(value, 64)
+
+		if err != nil || result < 0 {
+			return fmt.Errorf("expected a non negative number, got %q", value)
+		}
+
+		*field(c) = result
+		return nil
+	}
+}
+
+func durationValue(field func(*Config) *time.Duration) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		result, err := time.ParseDuration(value)
+
+		if err != nil || result <= 0 {
+			return fmt.Errorf("expected a positive duration (e.g 10m, 90s), got %q", value)
+		}
+
+		*field(c) = result
+		return nil
+	}
+}
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v3"
+)
+
+// runs a command with the flags of every setting and the given arguments, and loads its config
+func load(t *testing.T, args ...string) (*Config, error) {
+	var cfg *Config
+	var err error
+
+	cmd := &cli.Command{
+		Name:  "pumpsync",
+		Flags: Flags(),
+		Action: func(ctx context.Context, cmd *cli.Command) error {
+			cfg, err = Load(cmd)
+			return nil
+		},
+	}
+
+	if runErr := cmd.Run(context.Background(), append([]string{"pumpsync"}, args...)); runErr != nil {
+		t.Fatal(runErr)
+	}
+
+	return cfg, err
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadPriority(t *testing.T) {
+
+	path := writeConfigFile(t, `{
+		"port": 8001,
+		"workers": 3,
+		"job_timeout": "5m",
+		"url_prefix": "https://file.example",
+		"youtube_cache_dir": "/var/cache/pumpsync"
+	}`)
+
+	t.Setenv("PUMPSYNC_CONFIG", path)
+	t.Setenv("PUMPSYNC_WORKERS", "4")
+	t.Setenv("PUMPSYNC_JOB_TIMEOUT", "7m")
+	t.Setenv("PUMPSYNC_MAX_QUEUED", "")
+	t.Setenv("PUMPSYNC_YOUTUBE_CACHE_DIR", "off")
+
+	cfg, err := load(t, "--job-timeout", "9m", "--debug", "true")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		setting   string
+		got, want any
+	}{
+		{"a default", cfg.LogFormat, "text"},
+		{"an empty variable", cfg.MaxQueued, 32},
+		{"the file over the default", cfg.Port, 8001},
+		{"the file", cfg.UrlPrefix, "https://file.example"},
+		{"a variable over the file", cfg.Workers, 4},
+		{"a flag over a variable", cfg.JobTimeout, 9 * time.Minute},
+		{"a flag over the default", cfg.Debug, true},
+		{"off over the file", cfg.YoutubeCacheDir, ""},
+	}
+
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s: got %v, want %v", test.setting, test.got, test.want)
+		}
+	}
+}
+
+func TestLoadIgnoresEmptyVariables(t *testing.T) {
+
+	t.Setenv("PUMPSYNC_PORT", "")
+	t.Setenv("PUMPSYNC_URL_PREFIX", "")
+	t.Setenv("PUMPSYNC_STORE", "")
+
+	cfg, err := load(t)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Port != 8000 || cfg.UrlPrefix != "http://127.0.0.1:8000" || cfg.Store != "filesystem" {
+		t.Errorf("expected the defaults, got %+v", cfg)
+	}
+}
+
+func TestLoadRejectsInvalidValues(t *testing.T) {
+
+	for _, args := range [][]string{
+		{"--port", "http"},
+		{"--store", "ftp"},
+		{"--config", writeConfigFile(t, `{"unknown_setting": 1}`)},
+		{"--config", writeConfigFile(t, `{"workers": [1]}`)},
+	} {
+		if _, err := load(t, args...); !errors.Is(err, InvalidConfigError) {
+			t.Errorf("%v: got %v, want an invalid config error", args, err)
+		}
+	}
+}
@@ -24,18 +24,22 @@ package handle
 // <<< upgrade to websocket
 // >> string message containing json object with youtube link and size of local video
 // >> bytes message containing the video itself
+// [the video is probed, the server replies with an error if it can't be edited]
+// [the youtube video is checked, the server replies with an error if it can't be used]
 // << string message ok (or error)
-// << suggestion: messages with status of what the server is doing, ETA
+// << string messages queued, with the position in the work queue
+// << string messages progress, with the stage the server is in, elapsed time and ETA
 // << string message finished
 // << url with video for download (lasts 5 minutes)
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"net/http"
 	"regexp"
+	"time"
 
 	"os"
 
@@ -47,31 +51,95 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
-var (
-	upgrader = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			// TODO: use proper CORS
-			return true
-		},
-	}
-)
-
 type ProcessingRequest struct {
-	Kind     string `json:"type"`      // overwrite_video || overwrite_audio, currently ignored
+	Kind     string `json:"type"`      // overwrite_video || overwrite_audio || overlay_video
 	VideoId  string `json:"video_id"`  // id of youtube video, base64-esque string
 	FileSize int    `json:"file_size"` // size of file, strictly positive and less than the defiend limits
+
+	Overlay *OverlaySettings `json:"overlay"` // optional, only used by overlay_video
+	Format  string           `json:"format"`  // m4a || flac || wav, optional (defaults to m4a), only used by overwrite_audio
+}
+
+// how the chart video is shown on top of the gameplay video, every field is optional
+type OverlaySettings struct {
+	Position *string  `json:"position"` // top_left || top_right || bottom_left || bottom_right
+	Scale    *float64 `json:"scale"`    // width of the chart video relative to the gameplay video, in (0, 1]
+	Opacity  *float64 `json:"opacity"`  // in (0, 1]
+}
+
+func (request *ProcessingRequest) overlayOptions() mediasync.OverlayOptions {
+	result := mediasync.DefaultOverlayOptions
+
+	if request.Overlay == nil {
+		return result
+	}
+
+	if request.Overlay.Position != nil {
+		result.Position = *request.Overlay.Position
+	}
+
+	if request.Overlay.Scale != nil {
+		result.Scale = *request.Overlay.Scale
+	}
+
+	if request.Overlay.Opacity != nil {
+		result.Opacity = *request.Overlay.Opacity
+	}
+
+	return result
+}
+
+func (request *ProcessingRequest) kind() mediasync.Kind {
+	switch request.Kind {
+	case "overlay_video":
+		return mediasync.KindOverlayVideo
+	case "overwrite_audio":
+		return mediasync.KindOverwriteAudio
+	default:
+		return mediasync.KindOverwriteVideo
+	}
+}
+
+func (request *ProcessingRequest) audioFormat() mediasync.AudioFormat {
+	if request.Format == "" {
+		return mediasync.AudioFormatM4a
+	}
+
+	return mediasync.AudioFormat(request.Format)
 }
 
 type StatusMessage struct {
-	Status    string  `json:"status"` // ok || error | done
-	ErrorTag *string `json:"error"`
-	ResultId  *string `json:"result_id"`
+	Status   string        `json:"status"` // ok || queued || progress || error || done
+	ErrorTag *string       `json:"error"`
+	ResultId *string       `json:"result_id"`
+	Position *int          `json:"position,omitempty"` // position in the work queue, when queued
+	Progress *ProgressInfo `json:"progress,omitempty"`
+}
+
+type ProgressInfo struct {
+	Stage     string  `json:"stage"`               // downloading || extracting_audio || detecting_delimiters || locating || mixing || muxing
+	Delimiter string  `json:"delimiter,omitempty"` // game version the youtube video matched, once detecting_delimiters finishes
+	Elapsed   float64 `json:"elapsed"`             // seconds since the edit started
+	ETA       float64 `json:"eta"`                 // rough estimate of seconds left
 }
 
 func okMessage() StatusMessage {
 	return StatusMessage{Status: "ok", ErrorTag: nil, ResultId: nil}
 }
 
+func queuedMessage(position int) StatusMessage {
+	return StatusMessage{Status: "queued", Position: &position}
+}
+
+func progressMessage(event mediasync.ProgressEvent) StatusMessage {
+	return StatusMessage{Status: "progress", Progress: &ProgressInfo{
+		Stage:     string(event.Stage),
+		Delimiter: event.Delimiter,
+		Elapsed:   event.Elapsed.Seconds(),
+		ETA:       event.ETA.Seconds(),
+	}}
+}
+
 func doneMessage(id string) StatusMessage {
 	return StatusMessage{Status: "done", ErrorTag: nil, ResultId: &id}
 }
@@ -80,16 +148,30 @@ func errorMessage(err *responseError) StatusMessage {
 	return StatusMessage{Status: "error", ErrorTag: &err.tag}
 }
 
-const maxFileSize = 1024 * 1024 * 500
+// the cause of the edit context cancellation when the client closes the websocket
+var clientGone = errors.New("client closed the websocket")
 
-func HandleEditRequest(store *video_store.VideoStore, c echo.Context) error {
+func HandleEditRequest(jobs *Jobs, origins *Origins, c echo.Context) error {
 
-	c.Logger().Info("got request!")
+	id, logger, err := newJobId()
+
+	if err != nil {
+		return err
+	}
+
+	logger.Info("got edit request", "remote_ip", c.RealIP())
+
+	// the request context is also cancelled when the server shuts down.
+	// the commands run before the job starts (e.g the youtube preflight) are also logged with the job id
+	ctx, cancel := context.WithCancelCause(mediasync.WithLogger(c.Request().Context(), logger))
+	defer cancel(nil)
+
+	upgrader := websocket.Upgrader{CheckOrigin: origins.Check}
 
 	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
 
 	if err != nil {
-		c.Logger().Error("failed to upgrade to websocket", err)
+		logger.Error("failed to upgrade to websocket", "err", err)
 		return err
 	}
 
@@ -98,12 +180,19 @@ func HandleEditRequest(store *video_store.VideoStore, c echo.Context) error {
 	var request ProcessingRequest
 
 	if err = ws.ReadJSON(&request); err != nil {
-		c.Logger().Error("failed to read json info from websocket", err)
+		logger.Error("failed to read json info from websocket", "err", err)
 		ws.WriteJSON(errorMessage(parseError))
 		return nil
 	}
 
-	if resErr := validateRequest(&request); resErr != nil {
+	if resErr := validateRequest(logger, &request, jobs.config.MaxUploadBytes); resErr != nil {
+		ws.WriteJSON(errorMessage(resErr))
+		return nil
+	}
+
+	info, resErr := preflightYoutubeVideo(ctx, logger, request.VideoId, jobs.config.MaxYoutubeDuration)
+
+	if resErr != nil {
 		ws.WriteJSON(errorMessage(resErr))
 		return nil
 	}
@@ -111,79 +200,184 @@ func HandleEditRequest(store *video_store.VideoStore, c echo.Context) error {
 	messageType, reader, err := ws.NextReader()
 
 	if err != nil {
-		c.Logger().Error("failed to read file from websocket", err)
+		logger.Error("failed to read file from websocket", "err", err)
 		return err
 	}
 
 	if messageType != websocket.BinaryMessage {
-		c.Logger().Error("expected binary message")
+		logger.Error("expected binary message", "message_type", messageType)
 		ws.WriteJSON(errorMessage(protocolViolation))
 		return nil
 	}
 
 	savedFile, err := saveInputVideoToDisk(reader, request.FileSize)
-	defer os.Remove(savedFile)
 
-	c.Logger().Debug("alright! file", savedFile, "saved to disk with size", request.FileSize)
+	if err != nil {
+		logger.Error("failed to save video to disk", "err", err)
+		ws.WriteJSON(errorMessage(serverError))
+		return nil
+	}
+
+	logger.Debug("gameplay video saved to disk", "path", savedFile, "size", request.FileSize)
+
+	if resErr := validateGameplayVideo(ctx, logger, savedFile, jobs.config.MaxGameplayDuration); resErr != nil {
+		os.Remove(savedFile)
+		ws.WriteJSON(errorMessage(resErr))
+		return nil
+	}
 
 	if err = ws.WriteJSON(okMessage()); err != nil {
-		c.Logger().Error("failed write ok status message", err)
+		logger.Error("failed write ok status message", "err", err)
+		os.Remove(savedFile)
 		return nil
 	}
 
-	youtubeUrl := fmt.Sprintf("http://youtube.com/watch?v=%s", request.VideoId)
+	go watchDisconnect(ws, cancel)
 
-	c.Logger().Info("video edited with sucess")
+	job, responseErr := jobs.start(ctx, id, logger, request, info.Title, savedFile)
 
-    result, responseErr := tryEditVideo(savedFile, youtubeUrl)
+	if responseErr != nil {
+		ws.WriteJSON(errorMessage(responseErr))
+		return nil
+	}
 
-    if responseErr != nil {
-        ws.WriteJSON(errorMessage(responseErr))
-    }
+	err = job.follow(ctx, func(message StatusMessage) error {
+		return ws.WriteJSON(message)
+	})
 
-	notifySuccess(store, ws, result)
+	if err != nil {
+		logger.Error("stopped sending status messages", "err", err)
+
+		if context.Cause(ctx) != clientGone {
+			ws.WriteJSON(errorMessage(serverShutdown))
+		}
+	}
 
 	return nil
 }
 
-// edits the video with the given request and file, and returns 
+// the client is not supposed to send anything after the video,
+// so we just wait for the websocket to be closed
+func watchDisconnect(ws *websocket.Conn, cancel context.CancelCauseFunc) {
+	for {
+		if _, _, err := ws.NextReader(); err != nil {
+			cancel(clientGone)
+			return
+		}
+	}
+}
+
+// edits the video with the given request and file, and returns
 // an apropiate response error if it fails
-func tryEditVideo(savedFile string, youtubeUrl string) (string, *responseError) {
+func tryEditVideo(ctx context.Context, logger *slog.Logger, savedFile string, youtubeUrl string, options mediasync.Options) (*mediasync.EditResult, *responseError) {
 
-	result, err := mediasync.ImproveAudio(savedFile, youtubeUrl)
+	result, err := mediasync.ImproveAudio(ctx, savedFile, youtubeUrl, options)
 
 	if err != nil {
-		slog.Error("video edit failed", "err", err)
+		logger.Error("video edit failed", "err", err)
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, editTimeout
+		} else if errors.Is(err, context.Canceled) {
+			return nil, serverShutdown
+		} else if errors.Is(err, mediasync.TooLowScoreError) {
+			return nil, editLocateFailed
+		} else if errors.Is(err, mediasync.DownloadError) {
+			return nil, editDownloadFailed
+		} else {
+			return nil, editFailedGeneric
+		}
+	}
+
+	return result, nil
+}
+
+func youtubeUrl(videoId string) string {
+	return fmt.Sprintf("http://youtube.com/watch?v=%s", videoId)
+}
+
+// checks if the youtube video can be edited, before the gameplay video is uploaded
+func preflightYoutubeVideo(ctx context.Context, logger *slog.Logger, videoId string, maxDuration time.Duration) (*mediasync.YoutubeInfo, *responseError) {
+
+	info, err := mediasync.PreflightYoutubeVideo(ctx, youtubeUrl(videoId), maxDuration)
+
+	if err != nil {
+		logger.Error("youtube video preflight failed", "id", videoId, "err", err)
+		return nil, youtubeResponseError(err)
+	}
+
+	return info, nil
+}
+
+// checks if the uploaded video can be edited, before it goes to the queue
+func validateGameplayVideo(ctx context.Context, logger *slog.Logger, path string, maxDuration time.Duration) *responseError {
+
+	_, err := mediasync.ValidateGameplayVideo(ctx, path, maxDuration)
 
-        if errors.Is(err, mediasync.TooLowScoreError) {
-            return "", editLocateFailed
-        } else if errors.Is(err, mediasync.DownloadError) {
-            return "", editDownloadFailed
-        } else {
-            return "", editFailedGeneric
-        }
+	if err == nil {
+		return nil
 	}
 
-    return result, nil
+	logger.Error("gameplay video validation failed", "err", err)
+
+	if errors.Is(err, mediasync.UnsupportedMediaError) {
+		return unsupportedMedia
+	} else if errors.Is(err, mediasync.NoVideoStreamError) {
+		return noVideoStream
+	} else if errors.Is(err, mediasync.NoAudioStreamError) {
+		return noAudioStream
+	} else if errors.Is(err, mediasync.GameplayTooLongError) {
+		return gameplayTooLong
+	} else {
+		return serverError
+	}
 }
 
-func validateRequest(request *ProcessingRequest) *responseError {
+func youtubeResponseError(err error) *responseError {
+	if errors.Is(err, mediasync.YoutubeNotFoundError) {
+		return youtubeNotFound
+	} else if errors.Is(err, mediasync.YoutubePrivateError) {
+		return youtubePrivate
+	} else if errors.Is(err, mediasync.YoutubeLiveError) {
+		return youtubeLive
+	} else if errors.Is(err, mediasync.YoutubeTooLongError) {
+		return youtubeTooLong
+	} else {
+		return editDownloadFailed
+	}
+}
+
+func validateRequest(logger *slog.Logger, request *ProcessingRequest, maxFileSize int64) *responseError {
 
 	if request.FileSize < 0 {
-		slog.Error("request had negative file size")
+		logger.Error("request had negative file size", "size", request.FileSize)
 		return negativeFileSize
 	}
 
-	if request.FileSize > maxFileSize {
-		slog.Error("request size was too big")
+	if int64(request.FileSize) > maxFileSize {
+		logger.Error("request size was too big", "size", request.FileSize)
 		return fileTooBig
 	}
 
-	if request.Kind != "overwrite_video" && request.Kind != "overwrite_audio" {
-		slog.Error("illegal request kind")
+	if request.Kind != "overwrite_video" && request.Kind != "overwrite_audio" && request.Kind != "overlay_video" {
+		logger.Error("illegal request kind", "kind", request.Kind)
 		return protocolViolation
 	}
 
+	if request.Kind == "overlay_video" {
+		if err := request.overlayOptions().Validate(); err != nil {
+			logger.Error("invalid overlay options", "err", err)
+			return invalidOverlay
+		}
+	}
+
+	if request.Kind == "overwrite_audio" {
+		if err := request.audioFormat().Validate(); err != nil {
+			logger.Error("invalid audio format", "err", err)
+			return unsupportedFormat
+		}
+	}
+
 	return validateVideoId(request.VideoId)
 }
 
@@ -206,35 +400,39 @@ func validateVideoId(id string) *responseError {
 	return nil
 }
 
-func getUrlPrefix() string {
-    prefix := os.Getenv("PUMPSYNC_URL_PREFIX")
-
-    if prefix == "" {
-        prefix = "http://127.0.0.1:8000"
-    }
+// moves the result to the video store, and returns the signed url where it can be downloaded
+func (jobs *Jobs) storeResult(ctx context.Context, logger *slog.Logger, title string, result *mediasync.EditResult) (string, error) {
 
-    return prefix
-}
-
-func notifySuccess(store *video_store.VideoStore, ws *websocket.Conn, resultPath string) error {
-
-	uuid, err := store.AddVideo(resultPath)
+	diagnostics := video_store.Diagnostics{
+		Delimiter: mediasync.NoDelimiter,
+		Score:     result.Score,
+		Offset:    result.Offset,
+	}
 
-	if err != nil {
-		return err
+	if result.Match != nil {
+		diagnostics.Delimiter = result.Match.Identifier
+		diagnostics.StartScore = result.Match.StartScore
+		diagnostics.EndScore = result.Match.EndScore
 	}
 
-    prefix := getUrlPrefix()
+	metadata := video_store.Metadata{Title: title, Diagnostics: diagnostics}
 
-	url := fmt.Sprintf("%s/api/video/%s", prefix, uuid.String())
+	// the duration is only informative, so the result is stored anyway
+	if info, err := mediasync.ProbeMedia(ctx, result.Path); err == nil {
+		metadata.Duration = info.Duration
+	} else {
+		logger.Warn("failed to probe edit result", "err", err)
+	}
 
-	err = ws.WriteJSON(doneMessage(url))
+	uuid, err := jobs.store.AddVideo(ctx, result.Path, metadata)
 
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	query := jobs.signer.Sign(uuid, time.Now().Add(jobs.config.ResultTTL))
+
+	return fmt.Sprintf("%s/api/video/%s?%s", jobs.config.UrlPrefix, uuid.String(), query.Encode()), nil
 }
 
 func saveInputVideoToDisk(reader io.Reader, expectedSize int) (string, error) {
@@ -258,7 +456,7 @@ func saveInputVideoToDisk(reader io.Reader, expectedSize int) (string, error) {
 	_, err = io.CopyN(file, reader, int64(expectedSize))
 
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 
 	return path, nil
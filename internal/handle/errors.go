@@ -1,25 +1,46 @@
-
 package handle
 
 type responseError struct {
-    tag string
+	tag string
 }
 
 func (err *responseError) Error() string {
-    return err.tag
+	return err.tag
 }
 func newResponseError(tag string) *responseError {
-    return &responseError{ tag: tag }
+	return &responseError{tag: tag}
 }
 
 var protocolViolation = newResponseError("protocol_violation")
 var fileTooBig = newResponseError("file_too_big")
 var parseError = newResponseError("parse_error")
 var negativeFileSize = newResponseError("negative_size")
+var invalidOverlay = newResponseError("invalid_overlay")
+var unsupportedFormat = newResponseError("unsupported_format")
+
+var unsupportedMedia = newResponseError("unsupported_media")
+var noVideoStream = newResponseError("no_video_stream")
+var noAudioStream = newResponseError("no_audio_stream")
+var gameplayTooLong = newResponseError("gameplay_too_long")
 
 var serverError = newResponseError("server_error")
+var queueFull = newResponseError("queue_full")
+var serverShutdown = newResponseError("server_shutdown")
+var jobNotFound = newResponseError("job_not_found")
+var originNotAllowed = newResponseError("origin_not_allowed")
+var videoNotFound = newResponseError("video_not_found")
+var invalidRating = newResponseError("invalid_rating")
+var invalidLink = newResponseError("invalid_link")
+var linkExpired = newResponseError("link_expired")
+var downloadLimitReached = newResponseError("download_limit_reached")
 
 var editFailedGeneric = newResponseError("edit_failed")
 var editDownloadFailed = newResponseError("edit_download_failed")
 
+var youtubeNotFound = newResponseError("youtube_not_found")
+var youtubePrivate = newResponseError("youtube_private")
+var youtubeLive = newResponseError("youtube_live")
+var youtubeTooLong = newResponseError("youtube_too_long")
+
 var editLocateFailed = newResponseError("edit_locate_failed")
+var editTimeout = newResponseError("edit_timeout")
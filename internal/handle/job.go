@@ -0,0 +1,297 @@
+package handle
+
+// Edit jobs are shared by the websocket protocol (/api/edit) and the REST API (/api/jobs).
+// A job goes through the queued, progress and finally done or error statuses, and every
+// status change is published as a StatusMessage to whoever is following the job.
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/cosineblast/pumpsync/internal/config"
+	"github.com/cosineblast/pumpsync/internal/links"
+	"github.com/cosineblast/pumpsync/internal/mediasync"
+	"github.com/cosineblast/pumpsync/internal/metrics"
+	"github.com/cosineblast/pumpsync/internal/video_store"
+	"github.com/cosineblast/pumpsync/internal/work_queue"
+)
+
+// Jobs runs edit jobs in the work queue, and keeps track of them by id.
+type Jobs struct {
+	// jobs that don't belong to a connection (e.g the ones created with the REST API)
+	// run with this context, so they are cancelled when the server shuts down
+	ctx context.Context
+
+	config  *config.Config
+	store   video_store.VideoStore
+	signer  *links.Signer
+	queue   *work_queue.WorkQueue
+	options mediasync.Options
+
+	jobs sync.Map
+}
+
+func NewJobs(ctx context.Context, config *config.Config, store video_store.VideoStore, signer *links.Signer, queue *work_queue.WorkQueue, options mediasync.Options) *Jobs {
+	return &Jobs{ctx: ctx, config: config, store: store, signer: signer, queue: queue, options: options}
+}
+
+type editJob struct {
+	id     uuid.UUID
+	logger *slog.Logger // adds the job id to every log
+
+	mutex       sync.Mutex
+	status      StatusMessage
+	finished    bool
+	subscribers map[chan StatusMessage]struct{}
+}
+
+// Generates the id of a new job, which is generated before the job is started
+// so the logs of the whole request can be tied to it with the returned logger.
+func newJobId() (uuid.UUID, *slog.Logger, error) {
+
+	id, err := uuid.NewRandom()
+
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+
+	return id, slog.With("job", id.String()), nil
+}
+
+// Enqueues an edit of the video in inputPath with the given request, the job owns inputPath from now on.
+// title is the one of the youtube video, used to name the result. The job is cancelled when ctx is done.
+// id and logger are the ones from newJobId, every log of the edit (and of the commands it runs) goes to logger.
+func (jobs *Jobs) start(ctx context.Context, id uuid.UUID, logger *slog.Logger, request ProcessingRequest, title string, inputPath string) (*editJob, *responseError) {
+
+	job := &editJob{
+		id:          id,
+		logger:      logger,
+		status:      StatusMessage{Status: "queued"}, // the position is only known once it is submitted
+		subscribers: make(map[chan StatusMessage]struct{}),
+	}
+
+	ctx = mediasync.WithLogger(ctx, logger)
+
+	options := jobs.options
+	options.Logger = logger
+	options.Kind = request.kind()
+	options.Overlay = request.overlayOptions()
+	options.AudioFormat = request.audioFormat()
+
+	ticket, err := jobs.queue.Submit(func() {
+		jobs.run(ctx, job, inputPath, youtubeUrl(request.VideoId), title, options)
+	})
+
+	if err != nil {
+		logger.Error("failed to enqueue edit job", "err", err)
+		os.Remove(inputPath)
+		return nil, queueFull
+	}
+
+	// a worker may have picked it up already, in which case this is ignored
+	job.publish(queuedMessage(ticket.Position()))
+
+	jobs.jobs.Store(id, job)
+
+	go jobs.followQueue(ctx, job, ticket, inputPath)
+
+	return job, nil
+}
+
+// publishes the position of the job in the queue until a worker picks it up,
+// and takes it out of the queue if ctx is done before that
+func (jobs *Jobs) followQueue(ctx context.Context, job *editJob, ticket *work_queue.Ticket, inputPath string) {
+	for {
+		select {
+		case position := <-ticket.Positions():
+			job.publish(queuedMessage(position))
+
+		case <-ticket.Started():
+			return
+
+		case <-ticket.Done():
+			return
+
+		case <-ctx.Done():
+			if jobs.queue.Cancel(ticket) {
+				os.Remove(inputPath)
+				jobs.finish(job, errorMessage(serverShutdown))
+			}
+
+			return
+		}
+	}
+}
+
+func (jobs *Jobs) run(ctx context.Context, job *editJob, inputPath string, youtubeUrl string, title string, options mediasync.Options) {
+
+	defer os.Remove(inputPath)
+
+	options.Progress = func(event mediasync.ProgressEvent) {
+		job.publish(progressMessage(event))
+	}
+
+	job.logger.Info("edit job started", "kind", options.Kind, "youtube_url", youtubeUrl)
+
+	result, responseErr := tryEditVideo(ctx, job.logger, inputPath, youtubeUrl, options)
+
+	if responseErr != nil {
+		jobs.finish(job, errorMessage(responseErr))
+		return
+	}
+
+	url, err := jobs.storeResult(ctx, job.logger, title, result)
+
+	if err != nil {
+		job.logger.Error("failed to store edit result", "err", err)
+		jobs.finish(job, errorMessage(serverError))
+		return
+	}
+
+	job.logger.Info("video edited with success")
+
+	jobs.finish(job, doneMessage(url))
+}
+
+var finishedJobs = metrics.NewCounter("pumpsync_jobs_total",
+	"Finished edit jobs, by outcome (done or error) and error tag (empty when done).", "outcome", "tag")
+
+// publishes the last status of the job, which is then forgotten after a while
+func (jobs *Jobs) finish(job *editJob, message StatusMessage) {
+	job.publish(message)
+
+	tag := ""
+
+	if message.ErrorTag != nil {
+		tag = *message.ErrorTag
+	}
+
+	finishedJobs.Inc(message.Status, tag)
+
+	// as long as the result can be downloaded
+	time.AfterFunc(jobs.config.ResultTTL, func() {
+		jobs.jobs.Delete(job.id)
+	})
+}
+
+func (jobs *Jobs) find(id string) *editJob {
+	uid, err := uuid.Parse(id)
+
+	if err != nil {
+		return nil
+	}
+
+	job, ok := jobs.jobs.Load(uid)
+
+	if !ok {
+		return nil
+	}
+
+	return job.(*editJob)
+}
+
+func isFinalStatus(message StatusMessage) bool {
+	return message.Status == "done" || message.Status == "error"
+}
+
+func (job *editJob) publish(message StatusMessage) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	if job.finished {
+		return
+	}
+
+	// position updates may arrive late, after a worker picked up the job
+	if message.Status == "queued" && job.status.Status != "queued" {
+		return
+	}
+
+	job.status = message
+
+	if isFinalStatus(message) {
+		job.finished = true
+
+		for subscriber := range job.subscribers {
+			close(subscriber)
+		}
+
+		job.subscribers = nil
+		return
+	}
+
+	for subscriber := range job.subscribers {
+		select {
+		case subscriber <- message:
+		default:
+			// slow subscribers miss intermediate messages, but
+			// they always get the final one from follow
+		}
+	}
+}
+
+func (job *editJob) snapshot() StatusMessage {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	return job.status
+}
+
+// the returned channel receives the current status right away,
+// and is closed once the job finishes
+func (job *editJob) subscribe() (<-chan StatusMessage, func()) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	subscriber := make(chan StatusMessage, 32)
+
+	if job.finished {
+		close(subscriber)
+		return subscriber, func() {}
+	}
+
+	subscriber <- job.status
+
+	job.subscribers[subscriber] = struct{}{}
+
+	unsubscribe := func() {
+		job.mutex.Lock()
+		defer job.mutex.Unlock()
+
+		if _, ok := job.subscribers[subscriber]; ok {
+			delete(job.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+
+	return subscriber, unsubscribe
+}
+
+// calls send with every status of the job, until the job finishes (after
+// sending its final status), ctx is done or send fails.
+func (job *editJob) follow(ctx context.Context, send func(StatusMessage) error) error {
+
+	messages, unsubscribe := job.subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case message, ok := <-messages:
+			if !ok {
+				return send(job.snapshot())
+			}
+
+			if err := send(message); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package handle
+
+// REST version of the websocket edit protocol, for scripts and curl users:
+//
+// POST /api/jobs (multipart form with the fields `type`, `video_id` and the file `video`,
+// and optionally `format`, `overlay_position`, `overlay_scale` and `overlay_opacity`)
+// <- 202 { "id": ..., "status_url": ..., "events_url": ... }
+//
+// GET /api/jobs/:id
+// <- the last status message of the job, the same ones sent through the websocket
+//
+// GET /api/jobs/:id/events
+// <- server sent events with every status message of the job, the event name is the status
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/cosineblast/pumpsync/internal/mediasync"
+)
+
+type JobCreatedResponse struct {
+	Id        string `json:"id"`
+	StatusUrl string `json:"status_url"`
+	EventsUrl string `json:"events_url"`
+}
+
+type JobStatusResponse struct {
+	Id string `json:"id"`
+	StatusMessage
+}
+
+type ErrorResponse struct {
+	ErrorTag string `json:"error"`
+}
+
+func errorResponse(c echo.Context, code int, err *responseError) error {
+	return c.JSON(code, ErrorResponse{err.tag})
+}
+
+func HandleCreateJobRequest(jobs *Jobs, c echo.Context) error {
+
+	id, logger, err := newJobId()
+
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, serverError)
+	}
+
+	logger.Info("got job request", "remote_ip", c.RealIP())
+
+	// so the commands run before the job starts (e.g the youtube preflight) are also logged with the job id
+	ctx := mediasync.WithLogger(c.Request().Context(), logger)
+
+	header, err := c.FormFile("video")
+
+	if err != nil {
+		logger.Error("failed to read video from form", "err", err)
+		return errorResponse(c, http.StatusBadRequest, parseError)
+	}
+
+	request := ProcessingRequest{
+		Kind:     c.FormValue("type"),
+		VideoId:  c.FormValue("video_id"),
+		FileSize: int(header.Size),
+		Format:   c.FormValue("format"),
+	}
+
+	overlay, err := parseOverlayForm(c)
+
+	if err != nil {
+		logger.Error("failed to parse overlay settings", "err", err)
+		return errorResponse(c, http.StatusBadRequest, invalidOverlay)
+	}
+
+	request.Overlay = overlay
+
+	if resErr := validateRequest(logger, &request, jobs.config.MaxUploadBytes); resErr != nil {
+		return errorResponse(c, http.StatusBadRequest, resErr)
+	}
+
+	info, resErr := preflightYoutubeVideo(ctx, logger, request.VideoId, jobs.config.MaxYoutubeDuration)
+
+	if resErr != nil {
+		return errorResponse(c, youtubeStatusCode(resErr), resErr)
+	}
+
+	file, err := header.Open()
+
+	if err != nil {
+		logger.Error("failed to open uploaded video", "err", err)
+		return errorResponse(c, http.StatusInternalServerError, serverError)
+	}
+
+	defer file.Close()
+
+	savedFile, err := saveInputVideoToDisk(file, request.FileSize)
+
+	if err != nil {
+		logger.Error("failed to save video to disk", "err", err)
+		return errorResponse(c, http.StatusInternalServerError, serverError)
+	}
+
+	if resErr := validateGameplayVideo(ctx, logger, savedFile, jobs.config.MaxGameplayDuration); resErr != nil {
+		os.Remove(savedFile)
+
+		if resErr == serverError {
+			return errorResponse(c, http.StatusInternalServerError, resErr)
+		}
+
+		return errorResponse(c, http.StatusUnprocessableEntity, resErr)
+	}
+
+	// the job outlives this request
+	job, resErr := jobs.start(jobs.ctx, id, logger, request, info.Title, savedFile)
+
+	if resErr == queueFull {
+		return errorResponse(c, http.StatusServiceUnavailable, resErr)
+	} else if resErr != nil {
+		return errorResponse(c, http.StatusInternalServerError, resErr)
+	}
+
+	prefix := jobs.config.UrlPrefix
+
+	return c.JSON(http.StatusAccepted, JobCreatedResponse{
+		Id:        job.id.String(),
+		StatusUrl: fmt.Sprintf("%s/api/jobs/%s", prefix, job.id),
+		EventsUrl: fmt.Sprintf("%s/api/jobs/%s/events", prefix, job.id),
+	})
+}
+
+func parseOverlayForm(c echo.Context) (*OverlaySettings, error) {
+	var settings OverlaySettings
+
+	if position := c.FormValue("overlay_position"); position != "" {
+		settings.Position = &position
+	}
+
+	for field, target := range map[string]**float64{"overlay_scale": &settings.Scale, "overlay_opacity": &settings.Opacity} {
+		value := c.FormValue(field)
+
+		if value == "" {
+			continue
+		}
+
+		number, err := strconv.ParseFloat(value, 64)
+
+		if err != nil {
+			return nil, err
+		}
+
+		*target = &number
+	}
+
+	return &settings, nil
+}
+
+func HandleJobStatusRequest(jobs *Jobs, c echo.Context) error {
+
+	job := jobs.find(c.Param("id"))
+
+	if job == nil {
+		return errorResponse(c, http.StatusNotFound, jobNotFound)
+	}
+
+	return c.JSON(http.StatusOK, JobStatusResponse{job.id.String(), job.snapshot()})
+}
+
+func HandleJobEventsRequest(jobs *Jobs, c echo.Context) error {
+
+	job := jobs.find(c.Param("id"))
+
+	if job == nil {
+		return errorResponse(c, http.StatusNotFound, jobNotFound)
+	}
+
+	response := c.Response()
+
+	response.Header().Set(echo.HeaderContentType, "text/event-stream")
+	response.Header().Set(echo.HeaderCacheControl, "no-cache")
+	response.Header().Set(echo.HeaderConnection, "keep-alive")
+	response.WriteHeader(http.StatusOK)
+	response.Flush()
+
+	err := job.follow(c.Request().Context(), func(message StatusMessage) error {
+		data, err := json.Marshal(message)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(response, "event: %s\ndata: %s\n\n", message.Status, data)
+
+		if err != nil {
+			return err
+		}
+
+		response.Flush()
+
+		return nil
+	})
+
+	if err != nil {
+		job.logger.Debug("stopped sending job events", "err", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package handle
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+
+	"github.com/cosineblast/pumpsync/internal/metrics"
+)
+
+// Origins decides which websites may use this server through their visitors' browsers,
+// both for plain HTTP requests and for the edit websocket.
+// Requests without an Origin header (e.g from curl) and requests from the server's own host are always allowed.
+type Origins struct {
+	allowed map[string]bool
+	any     bool
+}
+
+var rejectedOrigins = metrics.NewCounter("pumpsync_rejected_origins_total",
+	"Requests (and websocket upgrades) rejected because their origin is not allowed.")
+
+// origins are of the form scheme://host[:port], "*" allows every origin
+func NewOrigins(origins []string) *Origins {
+	result := &Origins{allowed: make(map[string]bool)}
+
+	for _, origin := range origins {
+		if origin == "*" {
+			result.any = true
+		}
+
+		result.allowed[strings.ToLower(origin)] = true
+	}
+
+	return result
+}
+
+func (o *Origins) isAllowed(origin string, host string) bool {
+	if origin == "" || o.any || o.allowed[strings.ToLower(origin)] {
+		return true
+	}
+
+	parsed, err := url.Parse(origin)
+
+	return err == nil && strings.EqualFold(parsed.Host, host)
+}
+
+// checks the Origin header of the request, logging and counting rejected origins
+func (o *Origins) Check(r *http.Request) bool {
+	origin := r.Header.Get(echo.HeaderOrigin)
+
+	if o.isAllowed(origin, r.Host) {
+		return true
+	}
+
+	rejectedOrigins.Inc()
+
+	slog.Warn("rejected request from origin", "origin", origin, "method", r.Method, "path", r.URL.Path)
+
+	return false
+}
+
+// Rejects requests from origins which are not allowed, and adds the CORS headers to the other ones.
+// Browsers don't ask before sending simple requests (e.g form posts), so just not sending
+// the CORS headers is not enough to keep other sites from creating jobs.
+func (o *Origins) Middleware() echo.MiddlewareFunc {
+
+	cors := middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOriginFunc: func(origin string) (bool, error) {
+			return true, nil // already checked below
+		},
+		AllowMethods: []string{http.MethodGet, http.MethodPost},
+	})
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		withCors := cors(next)
+
+		return func(c echo.Context) error {
+			if !o.Check(c.Request()) {
+				return errorResponse(c, http.StatusForbidden, originNotAllowed)
+			}
+
+			return withCors(c)
+		}
+	}
+}
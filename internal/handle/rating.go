@@ -0,0 +1,68 @@
+package handle
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/cosineblast/pumpsync/internal/links"
+	"github.com/cosineblast/pumpsync/internal/ratings"
+	"github.com/cosineblast/pumpsync/internal/video_store"
+)
+
+const maxCommentLength = 2000
+
+// corrections bigger than this are more likely a wrong match than a small offset error
+const maxOffsetCorrectionMs = 60 * 1000
+
+type RatingRequest struct {
+	Rating             string `json:"rating"`               // up || down
+	OffsetCorrectionMs *int   `json:"offset_correction_ms"` // optional, positive if the music should start later
+	Comment            string `json:"comment"`              // optional
+}
+
+// POST /api/video/:id/rating, with the query of a signed link
+func HandleRatingRequest(store video_store.VideoStore, signer *links.Signer, ratingStore *ratings.RatingStore, c echo.Context) error {
+
+	video, status, resErr := fetchVideo(store, signer, c)
+
+	if resErr != nil {
+		return errorResponse(c, status, resErr)
+	}
+
+	var request RatingRequest
+
+	if err := c.Bind(&request); err != nil {
+		return errorResponse(c, http.StatusBadRequest, parseError)
+	}
+
+	if request.Rating != "up" && request.Rating != "down" {
+		return errorResponse(c, http.StatusBadRequest, invalidRating)
+	}
+
+	if correction := request.OffsetCorrectionMs; correction != nil && (*correction > maxOffsetCorrectionMs || *correction < -maxOffsetCorrectionMs) {
+		return errorResponse(c, http.StatusBadRequest, invalidRating)
+	}
+
+	if len(request.Comment) > maxCommentLength {
+		return errorResponse(c, http.StatusBadRequest, invalidRating)
+	}
+
+	rating := ratings.Rating{
+		VideoId:            video.Id.String(),
+		Created:            time.Now().UTC(),
+		ThumbsUp:           request.Rating == "up",
+		OffsetCorrectionMs: request.OffsetCorrectionMs,
+		Comment:            request.Comment,
+		Match:              video.Diagnostics,
+	}
+
+	if err := ratingStore.Add(rating); err != nil {
+		slog.Error("failed to store rating", "video", video.Id, "err", err)
+		return errorResponse(c, http.StatusInternalServerError, serverError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,64 @@
+package handle
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/cosineblast/pumpsync/internal/config"
+	"github.com/cosineblast/pumpsync/internal/health"
+	"github.com/cosineblast/pumpsync/internal/work_queue"
+)
+
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+type StatusResponse struct {
+	Ready   bool     `json:"ready"`
+	Failing []string `json:"failing"` // names of the dependency checks which failed, see /readyz
+
+	Queue QueueStatus `json:"queue"`
+}
+
+type QueueStatus struct {
+	Pending   int `json:"pending"` // jobs waiting for a worker
+	Active    int `json:"active"`  // jobs being run
+	Workers   int `json:"workers"`
+	MaxQueued int `json:"max_queued"`
+}
+
+// GET /healthz, the server is up (even if it can't edit videos)
+func HandleHealthRequest(c echo.Context) error {
+	return c.JSON(http.StatusOK, HealthResponse{"ok"})
+}
+
+// GET /readyz, every dependency check passed
+// <- 200 or 503 with the report of the checks
+func HandleReadyRequest(checker *health.Checker, c echo.Context) error {
+
+	report := checker.Report(c.Request().Context())
+
+	if !report.Ok {
+		return c.JSON(http.StatusServiceUnavailable, report)
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
+
+// GET /api/status, for the UI to show if the server can take edits and how busy it is
+func HandleStatusRequest(config *config.Config, checker *health.Checker, queue *work_queue.WorkQueue, c echo.Context) error {
+
+	report := checker.Report(c.Request().Context())
+
+	return c.JSON(http.StatusOK, StatusResponse{
+		Ready:   report.Ok,
+		Failing: report.Failing(),
+		Queue: QueueStatus{
+			Pending:   queue.Pending(),
+			Active:    queue.Active(),
+			Workers:   config.Workers,
+			MaxQueued: config.MaxQueued,
+		},
+	})
+}
@@ -1,30 +1,144 @@
 package handle
 
 import (
+	"errors"
+	"log/slog"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 
+	"github.com/cosineblast/pumpsync/internal/links"
 	"github.com/cosineblast/pumpsync/internal/video_store"
 )
 
-func HandleVideoDownloadRequest(store *video_store.VideoStore, c echo.Context) error {
+type VideoInfoResponse struct {
+	Id          string    `json:"id"`
+	FileName    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`     // in bytes
+	Duration    float64   `json:"duration"` // in seconds, 0 if unknown
+	Expires     time.Time `json:"expires"`  // when the video stops being available
 
-	id := c.Param("id")
+	Diagnostics video_store.Diagnostics `json:"diagnostics"`
+}
+
+// GET /api/video/:id, with the query of a signed link,
+// plus ?inline=1 if the video is meant to be played by the browser instead of saved
+func HandleVideoDownloadRequest(store video_store.VideoStore, signer *links.Signer, c echo.Context) error {
+
+	result, status, resErr := fetchVideo(store, signer, c)
+
+	if resErr != nil {
+		return errorResponse(c, status, resErr)
+	}
+
+	// players request ranges of the video as it plays, which are the same download
+	rangeHeader := c.Request().Header.Get("Range")
+	followUp := rangeHeader != "" && !strings.HasPrefix(rangeHeader, "bytes=0-")
+
+	if !signer.CountDownload(c.QueryParams(), followUp) {
+		return errorResponse(c, http.StatusGone, downloadLimitReached)
+	}
+
+	dispositionType := "attachment"
+
+	if inline, _ := strconv.ParseBool(c.QueryParam("inline")); inline {
+		dispositionType = "inline"
+	}
+
+	disposition := mime.FormatMediaType(dispositionType, map[string]string{"filename": result.FileName()})
+
+	// a presigned url can be downloaded any number of times without us knowing,
+	// so links with a download limit are always streamed
+	if !links.Limited(c.QueryParams()) {
+		url, err := store.DownloadURL(result, disposition)
+
+		if err != nil {
+			slog.Error("failed to presign video url", "video", result.Id, "err", err)
+			return errorResponse(c, http.StatusInternalServerError, serverError)
+		}
+
+		if url != "" {
+			return c.Redirect(http.StatusFound, url)
+		}
+	}
 
-	uid, err := uuid.Parse(id)
+	content, err := store.OpenVideo(c.Request().Context(), result)
 
 	if err != nil {
-		c.Logger().Error("invalid uid", uid)
-		return c.String(http.StatusNotFound, "")
+		slog.Error("failed to open video", "video", result.Id, "err", err)
+		return errorResponse(c, http.StatusInternalServerError, serverError)
 	}
 
-	result := store.FetchVideo(uid)
+	defer content.Close()
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, result.ContentType)
+	header.Set(echo.HeaderContentDisposition, disposition)
+
+	// results never change, so their id is enough as an etag
+	header.Set("ETag", strconv.Quote(result.Id.String()))
+
+	// takes care of range requests, and of the conditional ones with the etag or the last modified time
+	http.ServeContent(c.Response(), c.Request(), "", result.Created, content)
+
+	return nil
+}
+
+// GET /api/video/:id/info, with the query of a signed link
+func HandleVideoInfoRequest(store video_store.VideoStore, signer *links.Signer, c echo.Context) error {
+
+	result, status, resErr := fetchVideo(store, signer, c)
+
+	if resErr != nil {
+		return errorResponse(c, status, resErr)
+	}
+
+	return c.JSON(http.StatusOK, VideoInfoResponse{
+		Id:          result.Id.String(),
+		FileName:    result.FileName(),
+		ContentType: result.ContentType,
+		Size:        result.Size,
+		Duration:    result.Duration,
+		Expires:     result.Expires,
+		Diagnostics: result.Diagnostics,
+	})
+}
+
+// Looks up the video with the id in the path, if the request has a valid signed link to it.
+// The link is checked first, so forged links never reach the store.
+func fetchVideo(store video_store.VideoStore, signer *links.Signer, c echo.Context) (*video_store.Video, int, *responseError) {
+
+	uid, err := uuid.Parse(c.Param("id"))
+
+	if err != nil {
+		return nil, http.StatusNotFound, videoNotFound
+	}
+
+	err = signer.Verify(uid, c.QueryParams())
+
+	if errors.Is(err, links.ExpiredLinkError) {
+		return nil, http.StatusGone, linkExpired
+	} else if err != nil {
+		slog.Info("refused download link", "video", uid, "err", err)
+		return nil, http.StatusForbidden, invalidLink
+	}
+
+	result, err := store.FetchVideo(c.Request().Context(), uid)
+
+	if err != nil {
+		slog.Error("failed to fetch video", "video", uid, "err", err)
+		return nil, http.StatusInternalServerError, serverError
+	}
 
 	if result == nil {
-		return c.String(http.StatusNotFound, "")
+		return nil, http.StatusNotFound, videoNotFound
 	}
 
-	return c.Attachment(*result, "result.mp4")
+	return result, 0, nil
 }
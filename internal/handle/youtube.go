@@ -0,0 +1,65 @@
+package handle
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/cosineblast/pumpsync/internal/config"
+	"github.com/cosineblast/pumpsync/internal/mediasync"
+)
+
+type YoutubeInfoResponse struct {
+	Id        string  `json:"id"`
+	Title     string  `json:"title"`
+	Duration  float64 `json:"duration"` // in seconds
+	Thumbnail string  `json:"thumbnail"`
+
+	// why the video can't be edited (youtube_live or youtube_too_long), null if it can
+	ErrorTag *string `json:"error"`
+}
+
+// GET /api/youtube/:id/info
+func HandleYoutubeInfoRequest(config *config.Config, c echo.Context) error {
+
+	id := c.Param("id")
+
+	if resErr := validateVideoId(id); resErr != nil {
+		return errorResponse(c, http.StatusBadRequest, resErr)
+	}
+
+	info, err := mediasync.FetchYoutubeInfo(c.Request().Context(), youtubeUrl(id))
+
+	if err != nil {
+		slog.Error("failed to fetch youtube video info", "id", id, "err", err)
+		resErr := youtubeResponseError(err)
+		return errorResponse(c, youtubeStatusCode(resErr), resErr)
+	}
+
+	response := YoutubeInfoResponse{
+		Id:        info.Id,
+		Title:     info.Title,
+		Duration:  info.Duration,
+		Thumbnail: info.Thumbnail,
+	}
+
+	if err = info.Check(config.MaxYoutubeDuration); err != nil {
+		response.ErrorTag = &youtubeResponseError(err).tag
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func youtubeStatusCode(err *responseError) int {
+	switch err {
+	case youtubeNotFound:
+		return http.StatusNotFound
+	case youtubePrivate:
+		return http.StatusForbidden
+	case youtubeLive, youtubeTooLong:
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusBadGateway
+	}
+}
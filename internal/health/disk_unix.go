@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd
+
+package health
+
+import "syscall"
+
+// the space available to unprivileged users in the file system of path
+func freeBytes(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
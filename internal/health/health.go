@@ -0,0 +1,233 @@
+package health
+
+// Checks of everything the edits depend on besides the server itself: the programs they run,
+// the game delimiters, the temporary directory and the video store. They run when the server starts,
+// by `pumpsync doctor`, and again by the readiness endpoint whenever the last report is too old.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosineblast/pumpsync/internal/config"
+	"github.com/cosineblast/pumpsync/internal/mediasync"
+)
+
+// how long a report is reused before the checks run again
+const CHECK_INTERVAL = 30 * time.Second
+
+// how long each check may take
+const CHECK_TIMEOUT = 10 * time.Second
+
+// An edit keeps the upload, the youtube video (at most 512MB), the result and a few audio files
+// in the temporary directory, which is about 2GB with the default upload limit.
+const MINIMUM_FREE_TEMP_BYTES = 2 << 30
+
+var UnsupportedError = errors.New("not supported on this platform")
+
+type Check struct {
+	Name   string `json:"name"`
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail"` // e.g the version of a program, or why the check failed
+}
+
+type Report struct {
+	Ok      bool      `json:"ok"` // whether every check passed
+	Checked time.Time `json:"checked"`
+	Checks  []Check   `json:"checks"`
+}
+
+// the names of the checks which failed
+func (report *Report) Failing() []string {
+	failing := []string{}
+
+	for _, check := range report.Checks {
+		if !check.Ok {
+			failing = append(failing, check.Name)
+		}
+	}
+
+	return failing
+}
+
+type Checker struct {
+	config        *config.Config
+	storeWritable func(ctx context.Context) error
+
+	mutex sync.Mutex
+	last  *Report
+}
+
+// storeWritable tells if results can be written to the video store, e.g VideoStore.CheckWritable
+func NewChecker(config *config.Config, storeWritable func(ctx context.Context) error) *Checker {
+	return &Checker{config: config, storeWritable: storeWritable}
+}
+
+// The last report, or a new one if it is older than CHECK_INTERVAL.
+func (checker *Checker) Report(ctx context.Context) Report {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+
+	if checker.last == nil || time.Since(checker.last.Checked) > CHECK_INTERVAL {
+		report := checker.run(ctx)
+		checker.last = &report
+	}
+
+	return *checker.last
+}
+
+// Runs every check now.
+func (checker *Checker) Run(ctx context.Context) Report {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+
+	report := checker.run(ctx)
+	checker.last = &report
+
+	return report
+}
+
+func (checker *Checker) run(ctx context.Context) Report {
+
+	// the report is shared by every request, so it shouldn't fail because one of them was cancelled
+	ctx = context.WithoutCancel(ctx)
+
+	checks := []struct {
+		name string
+		run  func(ctx context.Context) (string, error)
+	}{
+		{"ffmpeg", programVersion("ffmpeg", "-version")},
+		{"ffprobe", programVersion("ffprobe", "-version")},
+		{"yt-dlp", programVersion("yt-dlp", "--version")},
+		{"locator", checker.checkLocator},
+		{"delimiters", checker.checkDelimiters},
+		{"temp_disk", checkTempDisk},
+		{"store", checker.checkStore},
+	}
+
+	report := Report{Ok: true, Checked: time.Now()}
+
+	for _, check := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, CHECK_TIMEOUT)
+		detail, err := check.run(checkCtx)
+		cancel()
+
+		if err != nil {
+			report.Ok = false
+			detail = err.Error()
+		}
+
+		report.Checks = append(report.Checks, Check{Name: check.name, Ok: err == nil, Detail: detail})
+	}
+
+	return report
+}
+
+// runs the program with the given flag, and returns the first line it prints (which usually has its version)
+func programVersion(name string, flag string) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		output, err := mediasync.ProgramVersion(ctx, name, flag)
+
+		if err != nil {
+			return "", err
+		}
+
+		line := firstLine(output)
+
+		// e.g `ffmpeg version 7.1 Copyright (c) 2000-2024 the FFmpeg developers`
+		line, _, _ = strings.Cut(line, " Copyright")
+
+		return strings.TrimSpace(line), nil
+	}
+}
+
+func firstLine(output []byte) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+	return line
+}
+
+func (checker *Checker) checkLocator(ctx context.Context) (string, error) {
+
+	locator, err := mediasync.NewLocator(checker.config.Locator, checker.config.LocatorPath)
+
+	if err != nil {
+		return "", err
+	}
+
+	switch locator := locator.(type) {
+	case mediasync.ExternalLocator:
+		return locator.Path, checkExecutable(locator.Path)
+
+	case mediasync.PythonLocator:
+		version, err := programVersion(locator.Interpreter, "--version")(ctx)
+
+		if err != nil {
+			return "", err
+		}
+
+		if _, err = os.Stat(locator.Script); err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("%s (%s)", locator.Script, version), nil
+
+	default:
+		return checker.config.Locator, nil
+	}
+}
+
+func checkExecutable(path string) error {
+
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", path)
+	}
+
+	return nil
+}
+
+// loading the delimiters checks if every sound is a mono wav file
+func (checker *Checker) checkDelimiters(ctx context.Context) (string, error) {
+
+	delimiters, err := mediasync.LoadDelimiters(checker.config.Delimiters)
+
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d packs", len(delimiters.Packs)), nil
+}
+
+func checkTempDisk(ctx context.Context) (string, error) {
+
+	dir := os.TempDir()
+
+	free, err := freeBytes(dir)
+
+	if errors.Is(err, UnsupportedError) {
+		return "free space unknown", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	detail := fmt.Sprintf("%dMB free in %s", free>>20, dir)
+
+	if free < MINIMUM_FREE_TEMP_BYTES {
+		return "", fmt.Errorf("%s, at least %dMB are needed", detail, MINIMUM_FREE_TEMP_BYTES>>20)
+	}
+
+	return detail, nil
+}
+
+func (checker *Checker) checkStore(ctx context.Context) (string, error) {
+	return checker.config.Store, checker.storeWritable(ctx)
+}
@@ -0,0 +1,223 @@
+package links
+
+// Download links carry their expiry time, the id of the key which signed them and, optionally,
+// how many times they can be used, signed with HMAC-SHA256 so they can't be forged or extended:
+//
+//	/api/video/<id>?expires=<unix time>&key=<key id>&max=<downloads>&sig=<signature>
+//
+// Keys are rotated by adding a new one in front of the list: links are signed with the first key,
+// and checked with whichever key signed them, until the old key is removed.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var InvalidLinkError = errors.New("invalid download link")
+var ExpiredLinkError = errors.New("expired download link")
+var InvalidKeysError = errors.New("invalid link keys")
+
+// how long after a counted download its follow ups aren't counted,
+// enough for a player to seek around a chart video while it plays
+const FOLLOW_UP_WINDOW = 10 * time.Minute
+
+// the minimum length of the secrets, in bytes
+const MINIMUM_SECRET_LENGTH = 16
+
+type Key struct {
+	Id     string
+	Secret []byte
+}
+
+type Signer struct {
+	keys []Key
+
+	// how many times each link can be downloaded, 0 for no limit
+	maxDownloads int
+
+	mutex     sync.Mutex
+	downloads map[string]*linkDownloads // by signature
+
+	now func() time.Time
+}
+
+type linkDownloads struct {
+	count int
+
+	// when the last counted download started
+	last time.Time
+}
+
+// Parses keys written as comma separated `<id>:<secret>` pairs, e.g `2025b:secret,2025a:older secret`.
+func ParseKeys(value string) ([]Key, error) {
+
+	var keys []Key
+
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+
+		if pair == "" {
+			continue
+		}
+
+		id, secret, ok := strings.Cut(pair, ":")
+
+		if !ok || id == "" {
+			return nil, fmt.Errorf("[%w] expected <id>:<secret> pairs", InvalidKeysError)
+		}
+
+		if len(secret) < MINIMUM_SECRET_LENGTH {
+			return nil, fmt.Errorf("[%w] the secret of key %s must have at least %d characters", InvalidKeysError, id, MINIMUM_SECRET_LENGTH)
+		}
+
+		keys = append(keys, Key{id, []byte(secret)})
+	}
+
+	return keys, nil
+}
+
+// Creates a signer which signs with the first key. When there are no keys, a random one is generated,
+// so links stop working when the server restarts.
+func NewSigner(keys []Key, maxDownloads int) (*Signer, error) {
+
+	if len(keys) == 0 {
+		secret := make([]byte, 32)
+
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+
+		keys = []Key{{"random", secret}}
+	}
+
+	return &Signer{keys: keys, maxDownloads: maxDownloads, downloads: make(map[string]*linkDownloads), now: time.Now}, nil
+}
+
+// The query of a link to the video with id, which works until expires.
+func (signer *Signer) Sign(id uuid.UUID, expires time.Time) url.Values {
+
+	key := signer.keys[0]
+
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("key", key.Id)
+
+	if signer.maxDownloads > 0 {
+		query.Set("max", strconv.Itoa(signer.maxDownloads))
+	}
+
+	query.Set("sig", signature(key.Secret, id, query))
+
+	return query
+}
+
+// Checks if query is the one of a link to the video with id which hasn't expired yet.
+func (signer *Signer) Verify(id uuid.UUID, query url.Values) error {
+
+	var key *Key
+
+	for i := range signer.keys {
+		if signer.keys[i].Id == query.Get("key") {
+			key = &signer.keys[i]
+		}
+	}
+
+	if key == nil {
+		return fmt.Errorf("[%w] unknown key %q", InvalidLinkError, query.Get("key"))
+	}
+
+	expected := signature(key.Secret, id, query)
+
+	if !hmac.Equal([]byte(expected), []byte(query.Get("sig"))) {
+		return fmt.Errorf("[%w] wrong signature", InvalidLinkError)
+	}
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+
+	if err != nil {
+		return fmt.Errorf("[%w] invalid expiry time", InvalidLinkError)
+	}
+
+	if time.Now().After(time.Unix(expires, 0)) {
+		return ExpiredLinkError
+	}
+
+	return nil
+}
+
+// Whether the link in query can only be downloaded a limited number of times.
+func Limited(query url.Values) bool {
+	max, err := strconv.Atoi(query.Get("max"))
+	return err == nil && max > 0
+}
+
+// Counts a download with the link in query (which must have been verified),
+// returns false if it was already downloaded as many times as it allows.
+// Follow ups of a download (e.g the ranges a player asks for as it plays) aren't counted,
+// but only for FOLLOW_UP_WINDOW after the last counted download, so they can't be used
+// to download the link again without counting.
+// Downloads are counted by each server, so with several servers a link can be used more times.
+func (signer *Signer) CountDownload(query url.Values, followUp bool) bool {
+
+	if !Limited(query) {
+		return true
+	}
+
+	max, _ := strconv.Atoi(query.Get("max"))
+
+	sig := query.Get("sig")
+
+	signer.mutex.Lock()
+	defer signer.mutex.Unlock()
+
+	now := signer.now()
+
+	downloads, counted := signer.downloads[sig]
+
+	if followUp && counted && now.Sub(downloads.last) <= FOLLOW_UP_WINDOW {
+		return true
+	}
+
+	if counted && downloads.count >= max {
+		return false
+	}
+
+	if !counted {
+		downloads = &linkDownloads{}
+		signer.downloads[sig] = downloads
+
+		expires, _ := strconv.ParseInt(query.Get("expires"), 10, 64)
+
+		// the link doesn't work anymore after it expires, so there's no need to remember it
+		time.AfterFunc(time.Until(time.Unix(expires, 0)), func() {
+			signer.mutex.Lock()
+			defer signer.mutex.Unlock()
+
+			delete(signer.downloads, sig)
+		})
+	}
+
+	downloads.count++
+	downloads.last = now
+
+	return true
+}
+
+func signature(secret []byte, id uuid.UUID, query url.Values) string {
+	mac := hmac.New(sha256.New, secret)
+
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", id, query.Get("expires"), query.Get("key"), query.Get("max"))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,91 @@
+package links
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestCountDownload(t *testing.T) {
+
+	signer, err := NewSigner([]Key{{"test", []byte("a secret of 16 bytes or more")}}, 2)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	signer.now = func() time.Time { return now }
+
+	link := signer.Sign(uuid.New(), now.Add(time.Hour))
+
+	// a range request after the start is counted when it comes first
+	if !signer.CountDownload(link, true) {
+		t.Fatal("the first download was refused")
+	}
+
+	if !signer.CountDownload(link, false) {
+		t.Fatal("the second download was refused")
+	}
+
+	if signer.CountDownload(link, false) {
+		t.Fatal("a third download was allowed")
+	}
+
+	// the player of the last download can still seek
+	now = now.Add(FOLLOW_UP_WINDOW / 2)
+
+	if !signer.CountDownload(link, true) {
+		t.Fatal("a follow up of the last download was refused")
+	}
+
+	// but once it's done, ranges are new downloads
+	now = now.Add(FOLLOW_UP_WINDOW)
+
+	for range 3 {
+		if signer.CountDownload(link, true) {
+			t.Fatal("a follow up was allowed after the limit")
+		}
+	}
+
+	other := signer.Sign(uuid.New(), now.Add(time.Hour))
+
+	for range 3 {
+		if !signer.CountDownload(other, true) {
+			t.Fatal("a follow up of a counted download was refused")
+		}
+	}
+
+	// a late follow up is counted, it's the last download the link allows
+	now = now.Add(FOLLOW_UP_WINDOW + time.Second)
+
+	if !signer.CountDownload(other, true) {
+		t.Fatal("the second download was refused")
+	}
+
+	if signer.CountDownload(other, false) {
+		t.Fatal("a third download was allowed")
+	}
+}
+
+func TestCountDownloadWithoutLimit(t *testing.T) {
+
+	signer, err := NewSigner(nil, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link := signer.Sign(uuid.New(), time.Now().Add(time.Hour))
+
+	if Limited(link) {
+		t.Fatal("expected an unlimited link")
+	}
+
+	for range 10 {
+		if !signer.CountDownload(link, false) {
+			t.Fatal("a download of an unlimited link was refused")
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package mediasync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Chart videos on youtube are recorded from the game, so they start and end with the game UI
+// sounds (the delimiters), which depend on the game version. A DelimiterPack describes the
+// delimiters of one game version, and is loaded from a manifest like res/delimiters.json.
+type DelimiterPack struct {
+	Id string `json:"id"` // e.g XX, reported as the identifier of the match
+
+	StartPath string `json:"start"` // start of music sound, relative to the manifest (unless absolute)
+	EndPath   string `json:"end"`   // end of music sound, relative to the manifest (unless absolute)
+
+	// the minimum scores for the delimiters to be considered found
+	StartConfidence float64 `json:"start_confidence"`
+	EndConfidence   float64 `json:"end_confidence"`
+
+	// how many seconds are cut after the start delimiter and before the end delimiter,
+	// because the delimiter sounds fade into the music
+	StartPadding float64 `json:"start_padding"`
+	EndPadding   float64 `json:"end_padding"`
+
+	StartDuration float64 `json:"-"` // in seconds, computed when the manifest is loaded
+}
+
+type Delimiters struct {
+	Packs []DelimiterPack `json:"packs"`
+}
+
+const DefaultDelimitersPath = "./res/delimiters.json"
+
+var InvalidDelimitersError = errors.New("invalid delimiters manifest")
+
+// Reads and validates the manifest in path, and computes the duration of each start delimiter.
+func LoadDelimiters(path string) (*Delimiters, error) {
+
+	content, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var delimiters Delimiters
+
+	if err = json.Unmarshal(content, &delimiters); err != nil {
+		return nil, fmt.Errorf("[%w] %s: %w", InvalidDelimitersError, path, err)
+	}
+
+	if len(delimiters.Packs) == 0 {
+		return nil, fmt.Errorf("[%w] %s: no packs", InvalidDelimitersError, path)
+	}
+
+	dir := filepath.Dir(path)
+	ids := make(map[string]bool)
+
+	for i := range delimiters.Packs {
+		pack := &delimiters.Packs[i]
+
+		if pack.Id == "" || pack.Id == NoDelimiter || ids[pack.Id] {
+			return nil, fmt.Errorf("[%w] %s: pack %d has a missing, reserved or repeated id %q", InvalidDelimitersError, path, i, pack.Id)
+		}
+
+		ids[pack.Id] = true
+
+		if pack.StartConfidence <= 0 || pack.EndConfidence <= 0 || pack.StartPadding < 0 || pack.EndPadding < 0 {
+			return nil, fmt.Errorf("[%w] %s: pack %s needs positive confidences and non negative paddings", InvalidDelimitersError, path, pack.Id)
+		}
+
+		pack.StartPath = resolvePath(dir, pack.StartPath)
+		pack.EndPath = resolvePath(dir, pack.EndPath)
+
+		pack.StartDuration, err = delimiterDuration(pack.StartPath)
+
+		if err != nil {
+			return nil, fmt.Errorf("[%w] %s: pack %s: %w", InvalidDelimitersError, path, pack.Id, err)
+		}
+
+		if _, err = delimiterDuration(pack.EndPath); err != nil {
+			return nil, fmt.Errorf("[%w] %s: pack %s: %w", InvalidDelimitersError, path, pack.Id, err)
+		}
+	}
+
+	return &delimiters, nil
+}
+
+func resolvePath(dir string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(dir, path)
+}
+
+// delimiters are located in the audio returned by extractAudioFromVideo, so they need the same format
+func delimiterDuration(path string) (float64, error) {
+
+	reader, err := openWav(path)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer reader.Close()
+
+	if reader.Channels != 1 {
+		return 0, fmt.Errorf("%s: [%w]", path, StereoAudioError)
+	}
+
+	if reader.SampleRate != extractedSampleRate {
+		return 0, fmt.Errorf("%s: [%w] expected %d, got %d", path, MismatchedSampleRateError, extractedSampleRate, reader.SampleRate)
+	}
+
+	return float64(reader.SampleCount) / float64(reader.SampleRate), nil
+}
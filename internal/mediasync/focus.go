@@ -0,0 +1,175 @@
+package mediasync
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// With the native locator, the FFT of the chart audio is shared by every delimiter, but each
+// located delimiter still holds a buffer as big as it (see locate.go), so we only locate a few
+// of them at the same time.
+const DEFAULT_FOCUS_WORKERS = 2
+
+// A pack whose scores are this many times its thresholds is taken as the match right away,
+// since the delimiters of different game versions don't sound alike.
+const DECISIVE_MATCH_MARGIN = 1.5
+
+var NoDelimitersError = errors.New("no delimiter packs were given")
+
+type packScores struct {
+	startOffset, startScore float64
+	endOffset, endScore     float64
+	located                 int // how many of the two delimiters were located
+}
+
+// how far above its thresholds the pack matched, less than 1 if it didn't
+func (scores *packScores) margin(pack *DelimiterPack) float64 {
+	return min(scores.startScore/pack.StartConfidence, scores.endScore/pack.EndConfidence)
+}
+
+// Locates the delimiters of every pack in the audio at path, with at most `workers` locates at the same time,
+// and returns the pack which matched with the biggest margin. The remaining locates are cancelled once
+// a pack matches with DECISIVE_MATCH_MARGIN.
+func focusAudio(ctx context.Context, path string, locator Locator, delimiters *Delimiters, workers int) (*FocusSuccess, error) {
+
+	if delimiters == nil {
+		return nil, NoDelimitersError
+	}
+
+	if workers <= 0 {
+		workers = DEFAULT_FOCUS_WORKERS
+	}
+
+	// every delimiter is located in the same chart audio
+	if native, ok := locator.(NativeLocator); ok {
+		locator = native.sharing(path)
+	}
+
+	focusCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	budget := make(chan struct{}, workers)
+
+	var (
+		mutex    sync.Mutex
+		wait     sync.WaitGroup
+		scores   = make([]packScores, len(delimiters.Packs))
+		decided  bool
+		firstErr error
+	)
+
+	locate := func(index int, end bool) {
+		defer wait.Done()
+
+		select {
+		case budget <- struct{}{}:
+		case <-focusCtx.Done():
+			return
+		}
+
+		defer func() { <-budget }()
+
+		if focusCtx.Err() != nil {
+			return
+		}
+
+		pack := &delimiters.Packs[index]
+
+		delimiterPath := pack.StartPath
+
+		if end {
+			delimiterPath = pack.EndPath
+		}
+
+		offset, score, err := locateAudio(focusCtx, locator, path, delimiterPath)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if decided {
+			return
+		}
+
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			cancel()
+			return
+		}
+
+		result := &scores[index]
+
+		if end {
+			result.endOffset, result.endScore = offset, score
+			delimiterScore.Observe(score, pack.Id, "end")
+		} else {
+			result.startOffset, result.startScore = offset, score
+			delimiterScore.Observe(score, pack.Id, "start")
+		}
+
+		result.located++
+
+		if result.located == 2 {
+			loggerFrom(ctx).Info("located delimiters", "delimiter", pack.Id, "start_score", result.startScore, "end_score", result.endScore)
+
+			if result.margin(pack) >= DECISIVE_MATCH_MARGIN {
+				decided = true
+				cancel()
+			}
+		}
+	}
+
+	for i := range delimiters.Packs {
+		wait.Add(2)
+		go locate(i, false)
+		go locate(i, true)
+	}
+
+	wait.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if firstErr != nil && !decided {
+		return nil, firstErr
+	}
+
+	var best *FocusSuccess
+	bestMargin := 1.0
+
+	attempts := make(map[string]FloatPair)
+
+	for i := range delimiters.Packs {
+		pack := &delimiters.Packs[i]
+		result := &scores[i]
+
+		// cancelled before both delimiters were located
+		if result.located < 2 {
+			continue
+		}
+
+		margin := result.margin(pack)
+
+		if margin < 1 {
+			attempts[pack.Id] = FloatPair{result.startScore, result.endScore}
+			continue
+		}
+
+		if best == nil || margin > bestMargin {
+			leftCut, rightCut := adjustCutOffset(pack, result.startOffset, result.endOffset)
+
+			best = &FocusSuccess{leftCut, rightCut, pack.Id, result.startScore, result.endScore}
+			bestMargin = margin
+		}
+	}
+
+	if best == nil {
+		return nil, FocusFail{attempts}
+	}
+
+	return best, nil
+}
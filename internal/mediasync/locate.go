@@ -0,0 +1,415 @@
+package mediasync
+
+// This file implements the detection of the offset of an audio file in another one,
+// known as 'haystack' and 'needle' respectively, without the need of external programs.
+//
+// It is a port of the rust program in the `locate` directory, and it should give the same
+// offset and score for the same input. Just like the rust program, it tries to use less than
+// 512MiB of RAM when given two 44.1k mono .wav files with 3 minutes of duration or less:
+// we only keep two FFT buffers and a twiddle table in memory, and every FFT is done in place.
+// When many needles are located in the same haystack (see focusAudio), the haystack buffer and
+// the twiddles are shared by all of them, so each extra needle only costs its own buffer.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+var MismatchedSampleRateError = errors.New("files have non matching sample rates")
+
+var StereoAudioError = errors.New("stereo audio files are not supported")
+
+// the FFTs can't be interrupted, so ctx is only checked between them.
+func locateAudioNative(ctx context.Context, haystackPath string, needlePath string) (LocateResult, error) {
+	return newHaystackSpectrum(haystackPath).locate(ctx, needlePath)
+}
+
+// The FFT of a haystack, computed by the first needle located in it and shared by the next ones.
+// Needles may be located at the same time, as the shared buffers are only read after they are computed.
+type haystackSpectrum struct {
+	path string
+
+	mutex    sync.Mutex
+	buffer   []complex64 // nil until a needle is located
+	twiddles []complex64
+}
+
+func newHaystackSpectrum(path string) *haystackSpectrum {
+	return &haystackSpectrum{path: path}
+}
+
+func (h *haystackSpectrum) locate(ctx context.Context, needlePath string) (LocateResult, error) {
+
+	start := time.Now()
+
+	haystackReader, err := openWav(h.path)
+
+	if err != nil {
+		return LocateResult{}, err
+	}
+
+	defer haystackReader.Close()
+
+	needleReader, err := openWav(needlePath)
+
+	if err != nil {
+		return LocateResult{}, err
+	}
+
+	defer needleReader.Close()
+
+	// right now our pipeline makes sure the files are mono, but in the future we may
+	// want to convert it to mono ourselves by averaging the channels
+	if haystackReader.Channels != 1 || needleReader.Channels != 1 {
+		return LocateResult{}, StereoAudioError
+	}
+
+	sampleRate := haystackReader.SampleRate
+
+	if sampleRate != needleReader.SampleRate {
+		return LocateResult{}, fmt.Errorf("[%w] %d != %d", MismatchedSampleRateError, sampleRate, needleReader.SampleRate)
+	}
+
+	haystackSampleCount := haystackReader.SampleCount
+	needleSampleCount := needleReader.SampleCount
+
+	if haystackSampleCount == 0 || needleSampleCount == 0 {
+		return LocateResult{}, nil
+	}
+
+	haystackBuffer, twiddles, err := h.transform(ctx, haystackReader, findTargetSize(haystackSampleCount, needleSampleCount))
+
+	if err != nil {
+		return LocateResult{}, err
+	}
+
+	// the spectrum may have been computed for a longer needle, and padding
+	// the needle to its size gives the same correlation
+	n := len(haystackBuffer)
+
+	needleBuffer, err := readAndPad(needleReader, n)
+
+	if err != nil {
+		return LocateResult{}, err
+	}
+
+	reverse(needleBuffer[:needleSampleCount])
+
+	computeFFT(needleBuffer, twiddles, false)
+
+	if err := ctx.Err(); err != nil {
+		return LocateResult{}, err
+	}
+
+	// the haystack buffer is shared, so the correlation is written to the needle buffer instead
+	correlation := computeCorrelationPostFFT(needleBuffer, haystackBuffer, twiddles)
+
+	correlation = correlation[:haystackSampleCount+needleSampleCount-1]
+
+	audioStart, score := locateAudioStart(correlation, needleSampleCount, haystackSampleCount, sampleRate)
+
+	diagnostics := map[string]any{
+		"sample_rate":      sampleRate,
+		"haystack_samples": haystackSampleCount,
+		"needle_samples":   needleSampleCount,
+		"fft_size":         n,
+		"elapsed_ms":       time.Since(start).Milliseconds(),
+	}
+
+	return LocateResult{float64(audioStart) / float64(sampleRate), score, diagnostics}, nil
+}
+
+// the FFT of the haystack with at least n points and its twiddles, reader must be positioned at its first sample
+func (h *haystackSpectrum) transform(ctx context.Context, reader *wavReader, n int) ([]complex64, []complex64, error) {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.buffer) >= n {
+		return h.buffer, h.twiddles, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// a smaller spectrum is of no use anymore
+	h.buffer, h.twiddles = nil, nil
+
+	twiddles := computeTwiddles(n)
+
+	buffer, err := readAndPad(reader, n)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	computeFFT(buffer, twiddles, false)
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	h.buffer, h.twiddles = buffer, twiddles
+
+	return buffer, twiddles, nil
+}
+
+func findTargetSize(mySize int, otherSize int) int {
+	n := mySize + otherSize - 1
+
+	if n <= 1 {
+		return 1
+	}
+
+	return 1 << bits.Len(uint(n-1))
+}
+
+func readAndPad(reader *wavReader, targetSize int) ([]complex64, error) {
+
+	buffer := make([]complex64, targetSize)
+
+	for i := 0; i < reader.SampleCount; i++ {
+		sample, err := reader.readSample()
+
+		if err != nil {
+			return nil, err
+		}
+
+		buffer[i] = complex(sample, 0)
+	}
+
+	return buffer, nil
+}
+
+func reverse(buffer []complex64) {
+	for i, j := 0, len(buffer)-1; i < j; i, j = i+1, j-1 {
+		buffer[i], buffer[j] = buffer[j], buffer[i]
+	}
+}
+
+// computes e^(-2πik/n) for every k in [0, n/2)
+func computeTwiddles(n int) []complex64 {
+
+	twiddles := make([]complex64, n/2)
+
+	for k := range twiddles {
+		sin, cos := math.Sincos(-2 * math.Pi * float64(k) / float64(n))
+		twiddles[k] = complex(float32(cos), float32(sin))
+	}
+
+	return twiddles
+}
+
+// in place iterative radix-2 FFT, len(buffer) must be a power of two,
+// and twiddles must have been computed for len(buffer).
+// the inverse transform is not normalized, just like rustfft.
+func computeFFT(buffer []complex64, twiddles []complex64, inverse bool) {
+
+	// the inverse transform is the conjugate of the forward transform of the conjugate
+	if inverse {
+		conjugate(buffer)
+		defer conjugate(buffer)
+	}
+
+	n := len(buffer)
+
+	if n <= 1 {
+		return
+	}
+
+	shift := bits.UintSize - bits.Len(uint(n-1))
+
+	for i := 0; i < n; i++ {
+		j := int(bits.Reverse(uint(i)) >> shift)
+
+		if i < j {
+			buffer[i], buffer[j] = buffer[j], buffer[i]
+		}
+	}
+
+	// the first stages only touch small contiguous blocks of the buffer,
+	// so we run all of them for each block before moving on to the next,
+	// which makes a lot better use of the cache than doing one pass per stage
+	block := min(n, fftBlockSize)
+
+	// the twiddles of each of these stages, one after the other,
+	// the ones for the stage of size 2*h start at index h-1
+	blockTwiddles := make([]complex64, 0, block-1)
+
+	for size := 2; size <= block; size <<= 1 {
+		blockTwiddles = gatherTwiddles(blockTwiddles, twiddles, n/size, size/2)
+	}
+
+	for start := 0; start < n; start += block {
+		for size := 2; size <= block; size <<= 1 {
+			butterflies(buffer[start:start+block], blockTwiddles[size/2-1:size-1])
+		}
+	}
+
+	// reading the twiddle table with a large stride for every block is
+	// really cache unfriendly, so we gather the ones the stage uses first,
+	// as long as they are not too many
+	var stageTwiddles []complex64
+
+	for size := block * 2; size <= n; size <<= 1 {
+		half := size / 2
+		step := n / size
+
+		if step == 1 {
+			butterflies(buffer, twiddles)
+		} else if half <= fftMaxGatheredTwiddles {
+			stageTwiddles = gatherTwiddles(stageTwiddles[:0], twiddles, step, half)
+			butterflies(buffer, stageTwiddles)
+		} else {
+			butterfliesStrided(buffer, twiddles, step, half)
+		}
+	}
+}
+
+const fftBlockSize = 1 << 12
+
+const fftMaxGatheredTwiddles = 1 << 16
+
+func gatherTwiddles(destination []complex64, twiddles []complex64, step int, count int) []complex64 {
+	for k := 0; k < count; k++ {
+		destination = append(destination, twiddles[k*step])
+	}
+
+	return destination
+}
+
+// runs the radix-2 butterflies of a single stage, whose size is twice the amount of twiddles
+func butterflies(buffer []complex64, twiddles []complex64) {
+
+	half := len(twiddles)
+
+	for start := 0; start < len(buffer); start += 2 * half {
+		even := buffer[start : start+half]
+		odd := buffer[start+half : start+2*half]
+
+		for k, w := range twiddles {
+			product := odd[k] * w
+
+			odd[k] = even[k] - product
+			even[k] += product
+		}
+	}
+}
+
+func butterfliesStrided(buffer []complex64, twiddles []complex64, step int, half int) {
+
+	for start := 0; start < len(buffer); start += 2 * half {
+		even := buffer[start : start+half]
+		odd := buffer[start+half : start+2*half]
+
+		for k := range even {
+			product := odd[k] * twiddles[k*step]
+
+			odd[k] = even[k] - product
+			even[k] += product
+		}
+	}
+}
+
+func conjugate(buffer []complex64) {
+	for i, value := range buffer {
+		buffer[i] = complex(real(value), -imag(value))
+	}
+}
+
+// receives two buffers in frequency domain, and computes the correlation for them.
+// the result is written to the haystack buffer.
+func computeCorrelationPostFFT(haystackBuffer []complex64, needleBuffer []complex64, twiddles []complex64) []complex64 {
+
+	n := len(haystackBuffer)
+
+	scale := float32(n)
+
+	for i := range haystackBuffer {
+		product := haystackBuffer[i] * needleBuffer[i]
+		haystackBuffer[i] = complex(real(product)/scale, imag(product)/scale)
+	}
+
+	computeFFT(haystackBuffer, twiddles, true)
+
+	return haystackBuffer
+}
+
+func computeMeanStddevReal(values []complex64) (float64, float64) {
+
+	sum := 0.0
+
+	for _, value := range values {
+		sum += float64(real(value))
+	}
+
+	mean := sum / float64(len(values))
+
+	variance := 0.0
+
+	for _, value := range values {
+		difference := float64(real(value)) - mean
+		variance += difference * difference
+	}
+
+	variance /= float64(len(values))
+
+	return mean, math.Sqrt(variance)
+}
+
+func locateAudioStart(correlation []complex64, needleSampleCount int, haystackSampleCount int, sampleRate int) (int, float64) {
+
+	minIndex := 0
+
+	for i, value := range correlation {
+		if real(value) < real(correlation[minIndex]) {
+			minIndex = i
+		}
+	}
+
+	fractionOfSecond := sampleRate / 10
+
+	windowEnd := min(minIndex+fractionOfSecond, len(correlation))
+
+	// our heuristic is to find the lowest point of correlation then
+	// find the highest point near that one.
+	// ties are resolved in the same way rust's max_by does, so the last one wins
+	maxPostMinIndex := 0
+
+	for i, value := range correlation[minIndex:windowEnd] {
+		if real(value) >= real(correlation[minIndex+maxPostMinIndex]) {
+			maxPostMinIndex = i
+		}
+	}
+
+	maxCorrelation := real(correlation[0])
+
+	for _, value := range correlation {
+		if real(value) >= maxCorrelation {
+			maxCorrelation = real(value)
+		}
+	}
+
+	audioStart := minIndex + maxPostMinIndex - needleSampleCount + 1
+
+	// now, we need to give a confidence score to our guess
+	mean, stddev := computeMeanStddevReal(correlation)
+
+	zScore := (float64(maxCorrelation) - mean) / stddev
+
+	// sometimes calculations go really wrong and we end up estimating
+	// that the audio starts somewhere impossible
+	// in that case, the right thing to do is to claim that we have absolutely
+	// no confidence on the result
+	if audioStart < 0 || audioStart >= haystackSampleCount {
+		return 0, 0
+	}
+
+	return audioStart, zScore
+}
@@ -0,0 +1,327 @@
+package mediasync
+
+import (
+	"context"
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func naiveDFTBin(input []complex64, k int, inverse bool) complex128 {
+	n := len(input)
+	sign := -1.0
+
+	if inverse {
+		sign = 1
+	}
+
+	var sum complex128
+
+	for j, value := range input {
+		angle := sign * 2 * math.Pi * float64(j) * float64(k) / float64(n)
+		sum += complex128(value) * cmplx.Exp(complex(0, angle))
+	}
+
+	return sum
+}
+
+func randomSignal(random *rand.Rand, n int) []complex64 {
+	signal := make([]complex64, n)
+
+	for i := range signal {
+		signal[i] = complex(float32(random.Float64()*2-1), float32(random.Float64()*2-1))
+	}
+
+	return signal
+}
+
+// checks the given bins of the fft of input against the naive dft
+func checkBins(t *testing.T, input []complex64, output []complex64, bins []int, inverse bool) {
+	t.Helper()
+
+	// the error of float32 ffts grows with the size and the magnitude of the values
+	tolerance := 1e-4 * math.Sqrt(float64(len(input))) * math.Log2(float64(len(input))+1)
+
+	for _, k := range bins {
+		expected := naiveDFTBin(input, k, inverse)
+
+		if difference := cmplx.Abs(complex128(output[k]) - expected); difference > tolerance {
+			t.Fatalf("n=%d bin %d: expected %v, got %v (difference %g)", len(input), k, expected, output[k], difference)
+		}
+	}
+}
+
+// every bin of small ffts, and the edges plus some random bins of larger ones, as the naive dft is quadratic
+func someBins(random *rand.Rand, n int) []int {
+
+	if n <= 1024 {
+		bins := make([]int, n)
+
+		for k := range bins {
+			bins[k] = k
+		}
+
+		return bins
+	}
+
+	bins := []int{0, 1, 2, 3, n / 4, n/2 - 1, n / 2, n/2 + 1, n - 1}
+
+	for range 24 {
+		bins = append(bins, random.Intn(n))
+	}
+
+	return bins
+}
+
+func TestFFTMatchesNaiveDFT(t *testing.T) {
+
+	random := rand.New(rand.NewSource(1))
+
+	// covers the single block case and the blocked stages after it
+	for _, n := range []int{1, 2, 4, 8, 64, 1024, fftBlockSize, fftBlockSize * 4} {
+		for _, inverse := range []bool{false, true} {
+			input := randomSignal(random, n)
+			output := append([]complex64(nil), input...)
+
+			computeFFT(output, computeTwiddles(n), inverse)
+
+			checkBins(t, input, output, someBins(random, n), inverse)
+		}
+	}
+}
+
+func TestFFTLargeSizes(t *testing.T) {
+
+	random := rand.New(rand.NewSource(2))
+
+	// large enough for the stages whose twiddles aren't gathered, so only some bins are compared
+	n := fftMaxGatheredTwiddles * 4
+
+	input := randomSignal(random, n)
+	output := append([]complex64(nil), input...)
+
+	computeFFT(output, computeTwiddles(n), false)
+
+	checkBins(t, input, output, someBins(random, n), false)
+}
+
+func TestFFTRoundTrip(t *testing.T) {
+
+	random := rand.New(rand.NewSource(3))
+
+	n := 1 << 16
+	twiddles := computeTwiddles(n)
+
+	input := randomSignal(random, n)
+	buffer := append([]complex64(nil), input...)
+
+	computeFFT(buffer, twiddles, false)
+	computeFFT(buffer, twiddles, true)
+
+	for i := range input {
+		// the inverse isn't normalized
+		value := buffer[i] / complex(float32(n), 0)
+
+		if cmplx.Abs(complex128(value-input[i])) > 1e-4 {
+			t.Fatalf("sample %d: expected %v, got %v", i, input[i], value)
+		}
+	}
+}
+
+// writes samples as a mono float wav file
+func writeSignalWav(t *testing.T, name string, sampleRate int, samples []float64) string {
+	t.Helper()
+
+	spec := wavSpec{format: wavFormatFloat, channels: 1, sampleRate: sampleRate, bitsPerSample: 32}
+
+	return writeTempFile(t, name, buildWav(t, spec, samples))
+}
+
+func noise(random *rand.Rand, n int) []float64 {
+	samples := make([]float64, n)
+
+	for i := range samples {
+		samples[i] = random.NormFloat64() * 1000
+	}
+
+	return samples
+}
+
+// the z-score of the highest correlation, computed without ffts
+func naiveCorrelationScore(haystack []float64, needle []float64) float64 {
+
+	var correlation []float64
+
+	// the same lags as the fft correlation, from the needle ending at the first
+	// haystack sample to the needle starting at the last one
+	for lag := -(len(needle) - 1); lag < len(haystack); lag++ {
+		sum := 0.0
+
+		for j, value := range needle {
+			if i := lag + j; i >= 0 && i < len(haystack) {
+				sum += haystack[i] * value
+			}
+		}
+
+		correlation = append(correlation, sum)
+	}
+
+	mean, maximum := 0.0, math.Inf(-1)
+
+	for _, value := range correlation {
+		mean += value
+		maximum = max(maximum, value)
+	}
+
+	mean /= float64(len(correlation))
+
+	variance := 0.0
+
+	for _, value := range correlation {
+		variance += (value - mean) * (value - mean)
+	}
+
+	return (maximum - mean) / math.Sqrt(variance/float64(len(correlation)))
+}
+
+func TestLocateAudioNativeFindsNeedle(t *testing.T) {
+
+	const sampleRate = 1000
+
+	random := rand.New(rand.NewSource(4))
+
+	// the heuristic takes the highest correlation within 0.1s after the lowest one, which in real
+	// recordings is right before the match. Here the needle is preceded by an inverted copy of itself,
+	// which gives the lowest correlation, so it has to be shorter than that
+	needle := noise(random, sampleRate/20)
+	inversionDistance := len(needle) + 10
+
+	for _, offset := range []int{inversionDistance, 4321, sampleRate * 7, sampleRate*20 - len(needle)} {
+		haystack := noise(random, sampleRate*20)
+
+		// the copies stand out from the rest of the haystack
+		for i := range haystack {
+			haystack[i] /= 10
+		}
+
+		for i, value := range needle {
+			haystack[offset-inversionDistance+i] = -value
+			haystack[offset+i] = value
+		}
+
+		result, err := locateAudioNative(context.Background(),
+			writeSignalWav(t, "haystack.wav", sampleRate, haystack),
+			writeSignalWav(t, "needle.wav", sampleRate, needle))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected := float64(offset) / sampleRate; result.Offset != expected {
+			t.Errorf("offset %d: expected start %v, got %v", offset, expected, result.Offset)
+		}
+
+		expected := naiveCorrelationScore(haystack, needle)
+
+		if math.Abs(result.Score-expected) > expected*1e-3 {
+			t.Errorf("offset %d: expected score %v, got %v", offset, expected, result.Score)
+		}
+
+		if result.Score < MINIMUM_FINAL_MATCH_SCORE {
+			t.Errorf("offset %d: expected a score above %v, got %v", offset, MINIMUM_FINAL_MATCH_SCORE, result.Score)
+		}
+	}
+}
+
+func TestLocateAudioNativeUnrelatedNeedle(t *testing.T) {
+
+	const sampleRate = 8000
+
+	random := rand.New(rand.NewSource(5))
+
+	result, err := locateAudioNative(context.Background(),
+		writeSignalWav(t, "haystack.wav", sampleRate, noise(random, sampleRate*20)),
+		writeSignalWav(t, "needle.wav", sampleRate, noise(random, sampleRate*3)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Score >= MINIMUM_FINAL_MATCH_SCORE {
+		t.Errorf("expected a score below %v, got %v", MINIMUM_FINAL_MATCH_SCORE, result.Score)
+	}
+}
+
+func TestLocateAudioNativeRejectsMismatchedFiles(t *testing.T) {
+
+	random := rand.New(rand.NewSource(6))
+
+	haystack := writeSignalWav(t, "haystack.wav", 8000, noise(random, 8000))
+	needle := writeSignalWav(t, "needle.wav", 16000, noise(random, 8000))
+
+	if _, err := locateAudioNative(context.Background(), haystack, needle); err == nil {
+		t.Fatal("expected mismatched sample rates to fail")
+	}
+
+	spec := wavSpec{format: wavFormatFloat, channels: 2, sampleRate: 8000, bitsPerSample: 32}
+	stereo := writeTempFile(t, "stereo.wav", buildWav(t, spec, noise(random, 1000)))
+
+	if _, err := locateAudioNative(context.Background(), haystack, stereo); err != StereoAudioError {
+		t.Fatalf("expected StereoAudioError, got %v", err)
+	}
+}
+
+func TestSharedHaystackMatchesSeparateLocates(t *testing.T) {
+
+	const sampleRate = 1000
+
+	random := rand.New(rand.NewSource(7))
+
+	haystackSamples := noise(random, sampleRate*30)
+	haystack := writeSignalWav(t, "haystack.wav", sampleRate, haystackSamples)
+
+	// the last needle is long enough to need a bigger FFT than the others
+	var needles []string
+
+	for i, length := range []int{sampleRate / 20, sampleRate / 2, sampleRate * 2, sampleRate * 13} {
+		offset := (i*4 + 1) * sampleRate
+		needles = append(needles, writeSignalWav(t, "needle.wav", sampleRate, haystackSamples[offset:offset+length]))
+	}
+
+	locator := NativeLocator{}.sharing(haystack)
+
+	results := make([]LocateResult, len(needles))
+	errs := make([]error, len(needles))
+
+	var wg sync.WaitGroup
+
+	for i, needle := range needles {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = locator.Locate(context.Background(), haystack, needle)
+		}()
+	}
+
+	wg.Wait()
+
+	for i, needle := range needles {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+
+		expected, err := locateAudioNative(context.Background(), haystack, needle)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if results[i].Offset != expected.Offset || math.Abs(results[i].Score-expected.Score) > expected.Score*1e-4 {
+			t.Errorf("needle %d: shared haystack gave %v (%v), separate locate gave %v (%v)",
+				i, results[i].Offset, results[i].Score, expected.Offset, expected.Score)
+		}
+	}
+}
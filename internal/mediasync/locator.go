@@ -0,0 +1,138 @@
+package mediasync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// A Locator tries to determine when does the audio in needlePath play in haystackPath.
+// Both files are expected to be mono .wav files with the same sample rate.
+type Locator interface {
+	Locate(ctx context.Context, haystackPath string, needlePath string) (LocateResult, error)
+}
+
+type LocateResult struct {
+	Offset float64 // in seconds
+	Score  float64 // confidence on the offset, higher is better
+
+	// implementation specific information about how the result was computed,
+	// mostly useful for comparing different locators
+	Diagnostics map[string]any
+}
+
+// Locates audio in process, with the code in locate.go
+type NativeLocator struct{}
+
+func (NativeLocator) Locate(ctx context.Context, haystackPath string, needlePath string) (LocateResult, error) {
+	defer observeStage("locate_audio", "native", time.Now())
+
+	return locateAudioNative(ctx, haystackPath, needlePath)
+}
+
+// A NativeLocator for many needles in the same haystack, which computes its FFT only once.
+type sharedHaystackLocator struct {
+	spectrum *haystackSpectrum
+}
+
+func (NativeLocator) sharing(haystackPath string) sharedHaystackLocator {
+	return sharedHaystackLocator{newHaystackSpectrum(haystackPath)}
+}
+
+func (l sharedHaystackLocator) Locate(ctx context.Context, haystackPath string, needlePath string) (LocateResult, error) {
+	defer observeStage("locate_audio", "native", time.Now())
+
+	if haystackPath != l.spectrum.path {
+		return locateAudioNative(ctx, haystackPath, needlePath)
+	}
+
+	return l.spectrum.locate(ctx, needlePath)
+}
+
+// Locates audio with the rust program in the `locate` directory
+type ExternalLocator struct {
+	Path string
+}
+
+func (l ExternalLocator) Locate(ctx context.Context, haystackPath string, needlePath string) (LocateResult, error) {
+	return runLocateCommand(newCommand(ctx, "locate_audio", l.Path, haystackPath, needlePath))
+}
+
+// Locates audio with the python reference implementation in `locate/locate_audio.py`
+type PythonLocator struct {
+	Interpreter string
+	Script      string
+}
+
+func (l PythonLocator) Locate(ctx context.Context, haystackPath string, needlePath string) (LocateResult, error) {
+	return runLocateCommand(newCommand(ctx, "locate_audio", l.Interpreter, l.Script, haystackPath, needlePath))
+}
+
+type audioMatch = struct {
+	Offset float64 `json:"offset"`
+	Score  float64 `json:"score"`
+}
+
+// runs a locate program which prints an audioMatch json object to stdout
+func runLocateCommand(cmd *command) (LocateResult, error) {
+
+	start := time.Now()
+
+	stdout, err := cmd.Output()
+
+	if errors.Is(err, exec.ErrDot) {
+		err = nil
+	}
+
+	if err != nil {
+		return LocateResult{}, err
+	}
+
+	var message audioMatch
+
+	err = json.Unmarshal(bytes.TrimSpace(stdout), &message)
+
+	if err != nil {
+		return LocateResult{}, err
+	}
+
+	diagnostics := map[string]any{
+		"program":    cmd.Args,
+		"elapsed_ms": time.Since(start).Milliseconds(),
+	}
+
+	return LocateResult{message.Offset, message.Score, diagnostics}, nil
+}
+
+var UnknownLocatorError = errors.New("unknown locator")
+
+// Creates the locator with the given name, which is one of `native`, `external` or `python`.
+// path overrides the location of the program or script used by the locator, if it is not empty.
+func NewLocator(name string, path string) (Locator, error) {
+
+	switch name {
+	case "", "native":
+		return NativeLocator{}, nil
+
+	case "external":
+		if path == "" {
+			path = "./locate_audio"
+		}
+
+		return ExternalLocator{Path: path}, nil
+
+	case "python":
+		if path == "" {
+			path = "./locate/locate_audio.py"
+		}
+
+		return PythonLocator{Interpreter: "python3", Script: path}, nil
+
+	default:
+		return nil, fmt.Errorf("[%w] %s", UnknownLocatorError, name)
+	}
+}
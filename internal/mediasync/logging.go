@@ -0,0 +1,43 @@
+package mediasync
+
+import (
+	"context"
+	"log/slog"
+)
+
+type loggerKey struct{}
+
+// Returns a context whose logger is used for the logs of everything done with it (e.g every command run),
+// so they can be told apart from the ones of other edits. ImproveAudio does this with Options.Logger.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// the logger of ctx, or the default one if it has none
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+
+	return slog.Default()
+}
+
+// the last bytes written to it, so commands printing a lot don't fill the memory
+type tailBuffer struct {
+	data  []byte
+	limit int
+}
+
+func (buffer *tailBuffer) Write(p []byte) (int, error) {
+	buffer.data = append(buffer.data, p...)
+
+	if excess := len(buffer.data) - buffer.limit; excess > 0 {
+		buffer.data = buffer.data[excess:]
+	}
+
+	return len(p), nil
+}
+
+func (buffer *tailBuffer) String() string {
+	return string(buffer.data)
+}
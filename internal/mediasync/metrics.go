@@ -0,0 +1,36 @@
+package mediasync
+
+import (
+	"time"
+
+	"github.com/cosineblast/pumpsync/internal/metrics"
+)
+
+var stageDuration = metrics.NewHistogram("pumpsync_stage_duration_seconds",
+	"How long each stage of the edits took, by stage and the program which ran it.",
+	metrics.DurationBuckets, "stage", "command")
+
+// the delimiter confidences are around 15 to 20
+var delimiterScoreBuckets = []float64{1, 2.5, 5, 7.5, 10, 15, 20, 30, 50, 75, 100}
+
+var delimiterScore = metrics.NewHistogram("pumpsync_delimiter_score",
+	"The scores of the delimiter sounds in chart videos, by delimiter pack and sound (start or end).",
+	delimiterScoreBuckets, "delimiter", "sound")
+
+// the final scores of good matches are usually above MINIMUM_FINAL_MATCH_SCORE
+var finalScoreBuckets = []float64{1, 2, 3, 4, 5, 6, 8, 10, 15, 20, 30, 50}
+
+var finalScore = metrics.NewHistogram("pumpsync_final_score",
+	"The scores of the chart music in gameplay videos, by the delimiter pack the chart video matched (or none).",
+	finalScoreBuckets, "delimiter")
+
+var youtubeCacheRequests = metrics.NewCounter("pumpsync_youtube_cache_requests_total",
+	"Youtube videos asked to the cache, by result: hit, miss (downloaded) or shared (waited for another download).", "result")
+
+var youtubeCacheEvictions = metrics.NewCounter("pumpsync_youtube_cache_evictions_total",
+	"Youtube videos removed from the cache to fit its size limit.")
+
+// meant to be deferred, e.g `defer observeStage("locate_audio", "native", time.Now())`
+func observeStage(stage string, command string, start time.Time) {
+	stageDuration.Observe(time.Since(start).Seconds(), stage, command)
+}
@@ -0,0 +1,121 @@
+package mediasync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the audio location code is optimized for files with 3 minutes or less
+const MAX_GAMEPLAY_DURATION = 3 * time.Minute
+
+// the containers gameplay videos may be in, as named by ffprobe's format_name
+var supportedContainers = map[string]bool{
+	"mov,mp4,m4a,3gp,3g2,mj2": true,
+	"matroska,webm":           true,
+	"avi":                     true,
+}
+
+var UnsupportedMediaError = errors.New("unsupported media")
+var NoVideoStreamError = errors.New("media has no video stream")
+var NoAudioStreamError = errors.New("media has no audio stream")
+var GameplayTooLongError = errors.New("gameplay video is too long")
+
+type MediaInfo struct {
+	Container string
+	Duration  float64 // in seconds
+
+	VideoCodec string // empty if there is no video stream
+	AudioCodec string // empty if there is no audio stream
+}
+
+type probeOutput = struct {
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+	} `json:"format"`
+
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+	} `json:"streams"`
+}
+
+// Reads the container, duration and streams of the media file with ffprobe.
+// Returns UnsupportedMediaError if ffprobe can't read it.
+func ProbeMedia(ctx context.Context, path string) (*MediaInfo, error) {
+
+	cmd := newCommand(ctx, "probe_media", "ffprobe", "-v", "error", "-show_format", "-show_streams", "-of", "json", path)
+
+	stdout, err := cmd.Output()
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("[%w] %w", UnsupportedMediaError, err)
+	}
+
+	var output probeOutput
+
+	if err = json.Unmarshal(stdout, &output); err != nil {
+		return nil, fmt.Errorf("[%w] %w", UnsupportedMediaError, err)
+	}
+
+	info := &MediaInfo{Container: output.Format.FormatName}
+
+	// some containers don't have a duration, which we treat as zero
+	if output.Format.Duration != "" {
+		info.Duration, err = strconv.ParseFloat(strings.TrimSpace(output.Format.Duration), 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("[%w] %w", UnsupportedMediaError, err)
+		}
+	}
+
+	for _, stream := range output.Streams {
+		if stream.CodecType == "video" && info.VideoCodec == "" {
+			info.VideoCodec = stream.CodecName
+		}
+
+		if stream.CodecType == "audio" && info.AudioCodec == "" {
+			info.AudioCodec = stream.CodecName
+		}
+	}
+
+	return info, nil
+}
+
+// Checks if the uploaded gameplay video can be edited: it needs to be in a supported container,
+// have both a video and an audio stream and last at most maxDuration.
+func ValidateGameplayVideo(ctx context.Context, path string, maxDuration time.Duration) (*MediaInfo, error) {
+
+	info, err := ProbeMedia(ctx, path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !supportedContainers[info.Container] {
+		return info, fmt.Errorf("[%w] container %s", UnsupportedMediaError, info.Container)
+	}
+
+	if info.VideoCodec == "" {
+		return info, NoVideoStreamError
+	}
+
+	if info.AudioCodec == "" {
+		return info, NoAudioStreamError
+	}
+
+	if info.Duration > maxDuration.Seconds() {
+		return info, fmt.Errorf("[%w] %.0f seconds, the limit is %s", GameplayTooLongError, info.Duration, maxDuration)
+	}
+
+	return info, nil
+}
@@ -0,0 +1,90 @@
+package mediasync
+
+import (
+	"time"
+)
+
+type Stage string
+
+const (
+	StageDownloading         Stage = "downloading"
+	StageExtractingAudio     Stage = "extracting_audio"
+	StageDetectingDelimiters Stage = "detecting_delimiters"
+	StageLocating            Stage = "locating"
+	StageMixing              Stage = "mixing"
+	StageMuxing              Stage = "muxing"
+)
+
+// the stages of ImproveAudio in order, with a rough estimate of
+// the fraction of the total time each of them takes
+var stageWeights = []struct {
+	stage  Stage
+	weight float64
+}{
+	{StageDownloading, 0.25},
+	{StageExtractingAudio, 0.10},
+	{StageDetectingDelimiters, 0.35},
+	{StageLocating, 0.15},
+	{StageMixing, 0.05},
+	{StageMuxing, 0.10},
+}
+
+// reported as the delimiter when the youtube video did not match any of them
+const NoDelimiter = "none"
+
+// what we expect a whole edit to take, used to guess the ETA
+// before any stage has finished
+const expectedEditDuration = 90 * time.Second
+
+type ProgressEvent struct {
+	Stage Stage
+
+	// identifier of the delimiter the youtube video matched (or NoDelimiter),
+	// only set in the detecting_delimiters event sent after the detection finishes
+	Delimiter string
+
+	Elapsed time.Duration // since ImproveAudio started
+	ETA     time.Duration // rough estimate of the time left
+}
+
+type progressTracker struct {
+	start    time.Time
+	callback func(ProgressEvent)
+}
+
+func newProgressTracker(callback func(ProgressEvent)) *progressTracker {
+	return &progressTracker{start: time.Now(), callback: callback}
+}
+
+// reports that the pipeline has entered the given stage
+func (t *progressTracker) enter(stage Stage) {
+	t.report(stage, "")
+}
+
+func (t *progressTracker) report(stage Stage, delimiter string) {
+	if t.callback == nil {
+		return
+	}
+
+	elapsed := time.Since(t.start)
+
+	t.callback(ProgressEvent{stage, delimiter, elapsed, estimateTimeLeft(stage, elapsed)})
+}
+
+func estimateTimeLeft(stage Stage, elapsed time.Duration) time.Duration {
+	completed := 0.0
+
+	for _, entry := range stageWeights {
+		if entry.stage == stage {
+			break
+		}
+
+		completed += entry.weight
+	}
+
+	if completed == 0 {
+		return max(expectedEditDuration-elapsed, 0)
+	}
+
+	return time.Duration(float64(elapsed) * (1 - completed) / completed)
+}
@@ -1,189 +1,204 @@
 package mediasync
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"math"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type FocusSuccess struct {
-	LeftCut    float64
-	RightCut   float64
-	Identifier string
-	StartScore float64
-	EndScore   float64
+	LeftCut    float64 `json:"left_cut"`
+	RightCut   float64 `json:"right_cut"`
+	Identifier string  `json:"identifier"`
+	StartScore float64 `json:"start_score"`
+	EndScore   float64 `json:"end_score"`
 }
 
 type FloatPair = struct {
-	left  float64
-	right float64
+	Left  float64
+	Right float64
 }
 
 type FocusFail struct {
-	attempts map[string]FloatPair
+	Attempts map[string]FloatPair // start and end scores of each delimiter pair
 }
 
 func (f FocusFail) Error() string {
 	return "Failed to find sample in file"
 }
 
-type audioMatch = struct {
-	Offset         float64 `json:"offset"`
-	Score          float64 `json:"score"`
-}
-
-func locateAudio(haystackPath string, needlePath string) (float64, float64, error) {
-	log.Println("running locate script")
-	cmd := newCommand("./locate_audio", haystackPath, needlePath)
-
-	stdout, err := cmd.Output()
+func locateAudio(ctx context.Context, locator Locator, haystackPath string, needlePath string) (float64, float64, error) {
 
-	if errors.Is(err, exec.ErrDot) {
-		err = nil
-	}
+	result, err := locator.Locate(ctx, haystackPath, needlePath)
 
 	if err != nil {
 		return 0, 0, err
 	}
 
-	var message audioMatch
-	message.Offset = 0
-	message.Score = 0
-
-	err = json.Unmarshal(stdout, &message)
+	loggerFrom(ctx).Info("located audio", "needle", needlePath, "offset", result.Offset, "score", result.Score, "diagnostics", result.Diagnostics)
 
-	if err != nil {
-		return 0, 0, err
-	}
-
-	return message.Offset, message.Score, nil
+	return result.Offset, result.Score, nil
 }
 
-const AUDIO_START_MINIMUM_CONFIDENCE = 20
-const AUDIO_END_MINIMUM_CONFIDENCE = 15
 const MINIMUM_FINAL_MATCH_SCORE = 6
 
-func adjustCutOffset(startOffset float64, startDuration float64, endOffset float64) (float64, float64) {
+func adjustCutOffset(pack *DelimiterPack, startOffset float64, endOffset float64) (float64, float64) {
 
 	// because the start-of-music audio has a fade-out, it is possible (and likely) that there
 	// is a tiny amount of audio from the start-of-music audio in next to audio[start_size+start_offset]
 	// so it is a good idea to move a little bit to the right
 
-	// right now we are just doing a 0.5 second cut to the right and left
+	// right now we are just doing a fixed cut to the right and left (the padding of the pack)
 	// but there might be better ways of doing this.
 
-	return startOffset + startDuration + 0.5, endOffset - 0.5
+	return startOffset + pack.StartDuration + pack.StartPadding, endOffset - pack.EndPadding
 
 }
 
-func focusAudio(path string) (*FocusSuccess, error) {
+// how much of the stderr of commands is kept for the debug logs
+const maxLoggedStderr = 16 * 1024
 
-	audioPairs := []struct {
-		key       string
-		startPath string
-		endPath   string
-	}{
-		{"XX", "./res/xx_start_of_music.wav", "./res/xx_end_of_music.wav"},
-		{"Phoenix", "./res/phoenix_start_of_music.wav", "./res/phoenix_end_of_music.wav"},
-	}
+// An external program run by the pipeline. Run and Output log its argv, exit code, duration and
+// (at debug level) stderr with the logger of its context, and record the duration in the stage metrics.
+type command struct {
+	*exec.Cmd
+	stage  string
+	logger *slog.Logger
+	stderr *tailBuffer
+}
 
-	attempts := make(map[string]FloatPair)
+// creates a command for the given stage (e.g extract_audio) that is killed when ctx is done
+func newCommand(ctx context.Context, stage string, name string, commands ...string) *command {
+	result := exec.CommandContext(ctx, name, commands...)
 
-	for _, entry := range audioPairs {
+	return &command{result, stage, loggerFrom(ctx), &tailBuffer{limit: maxLoggedStderr}}
+}
 
-		startOffset, startScore, err := locateAudio(path, entry.startPath)
+func (cmd *command) Run() error {
+	cmd.captureStderr()
 
-		if err != nil {
-			return nil, err
-		}
+	start := time.Now()
+	err := cmd.Cmd.Run()
+	cmd.finished(start, err)
 
-        startDuration, err := getFileDuration(entry.startPath)
+	return err
+}
 
-        if err != nil {
-            return nil, err
-        }
+func (cmd *command) Output() ([]byte, error) {
+	cmd.captureStderr()
 
-		log.Println("checking if audio matches ", entry.key)
+	start := time.Now()
+	stdout, err := cmd.Cmd.Output()
+	cmd.finished(start, err)
 
-		endOffset, endScore, err := locateAudio(path, entry.endPath)
+	return stdout, err
+}
 
-		if err != nil {
-			return nil, err
-		}
+// callers may read the stderr themselves, so we only add our buffer to theirs
+func (cmd *command) captureStderr() {
+	if cmd.Stderr != nil {
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, cmd.stderr)
+	} else {
+		cmd.Stderr = cmd.stderr
+	}
+}
 
-		if startScore < AUDIO_START_MINIMUM_CONFIDENCE || endScore < AUDIO_END_MINIMUM_CONFIDENCE {
-			attempts[entry.key] = FloatPair{startScore, endScore}
-		} else {
-			leftCut, rightCut := adjustCutOffset(startOffset, startDuration, endOffset)
+func (cmd *command) finished(start time.Time, err error) {
+	elapsed := time.Since(start)
 
-			return &FocusSuccess{leftCut, rightCut, entry.key, startScore, endScore}, nil
-		}
-	}
+	stageDuration.Observe(elapsed.Seconds(), cmd.stage, filepath.Base(cmd.Path))
 
-	return nil, FocusFail{attempts}
+	exitCode := -1
 
-}
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
 
-func newCommand(name string, commands ...string) *exec.Cmd {
-    result := exec.Command(name, commands...)
+	attributes := []any{"stage", cmd.stage, "argv", cmd.Args, "exit_code", exitCode, "duration", elapsed}
 
-    if os.Getenv("PUMPSYNC_DEBUG") == "1" {
-        result.Stderr = os.Stderr
-    }
+	if cmd.logger.Enabled(context.Background(), slog.LevelDebug) {
+		attributes = append(attributes, "stderr", cmd.stderr.String())
+	}
 
-    return result
+	if err != nil {
+		cmd.logger.Error("command failed", append(attributes, "err", err)...)
+	} else {
+		cmd.logger.Info("command finished", attributes...)
+	}
 }
 
-func trimAudioSilence(path string) (string, error) {
-	outputFile, err := os.CreateTemp("", "pumpsync_*_ffmpeg_trim.wav")
+// the level below which chart audio is taken as silence, in dBFS
+const SILENCE_THRESHOLD_DB = -30
+
+// Finds the range of the wav file in path, within from and to (in seconds), where the audio is not silent.
+// Returns the whole range if it is silent all along.
+func findAudibleRange(path string, from float64, to float64) (float64, float64, error) {
+
+	reader, err := openWav(path)
 
 	if err != nil {
-		return "", err
+		return 0, 0, err
 	}
 
-	defer func() {
-		if err != nil {
-			os.Remove(outputFile.Name())
-		}
-	}()
+	defer reader.Close()
 
-	outputFile.Close()
+	sampleRate := float64(reader.SampleRate)
 
-	outputPath := outputFile.Name()
+	// clamped before converting, since to is infinite when there is no cut,
+	// and converting an infinite float to an int gives garbage
+	first, last := 0, reader.SampleCount
 
-	cmd := newCommand(
-		"ffmpeg",
-		"-y",       // don't ask for overwrite confirmation
-		"-i", path, // read from this file as input 0
-		"-af", // and remove silence from start and end
-		`silenceremove=
-            start_periods=1
-            :start_duration=0
-            :start_threshold=-30dB
-        ,areverse
-        ,silenceremove=
-            start_periods=1
-            :start_duration=0
-            :start_threshold=-30dB
-        ,areverse`,
-		outputPath)
+	if start := math.Floor(from * sampleRate); start > 0 {
+		first = int(min(start, float64(last)))
+	}
 
-	log.Println("running ffmpeg for silence removal")
-	err = cmd.Run()
+	if end := math.Ceil(to * sampleRate); end < float64(last) {
+		last = max(first, int(end))
+	}
 
-	if err != nil {
-		return "", err
+	threshold := float32(math.Pow(10, SILENCE_THRESHOLD_DB/20.0) * reader.fullScale())
+
+	audibleStart, audibleEnd := -1, -1
+
+	for i := 0; i < last; i++ {
+		loud := false
+
+		for range reader.Channels {
+			sample, err := reader.readSample()
+
+			if err != nil {
+				return 0, 0, err
+			}
+
+			loud = loud || sample >= threshold || sample <= -threshold
+		}
+
+		if i >= first && loud {
+			if audibleStart < 0 {
+				audibleStart = i
+			}
+
+			audibleEnd = i + 1
+		}
 	}
 
-	return outputPath, nil
+	if audibleStart < 0 {
+		return float64(first) / sampleRate, float64(last) / sampleRate, nil
+	}
+
+	return float64(audibleStart) / sampleRate, float64(audibleEnd) / sampleRate, nil
 }
 
-func cutAudio(path string, startOffset float64, endOffset float64) (string, error) {
+func cutAudio(ctx context.Context, stage string, path string, startOffset float64, endOffset float64) (string, error) {
 
 	outputFile, err := os.CreateTemp("", "pumpsync_*_ffmpeg_cut.wav")
 
@@ -202,6 +217,8 @@ func cutAudio(path string, startOffset float64, endOffset float64) (string, erro
 	outputFile.Close()
 
 	cmd := newCommand(
+		ctx,
+		stage,
 		"ffmpeg",
 		"-y",                           // don't ask for overwrite confirmation
 		"-ss", fmt.Sprint(startOffset), // seek to this offset
@@ -209,7 +226,6 @@ func cutAudio(path string, startOffset float64, endOffset float64) (string, erro
 		"-i", path, // of this file
 		outputPath)
 
-	log.Println("running ffmpeg for cut")
 	err = cmd.Run()
 
 	if err != nil {
@@ -219,68 +235,70 @@ func cutAudio(path string, startOffset float64, endOffset float64) (string, erro
 	return outputPath, nil
 }
 
-func focusAndTrimPumpAudio(foregroundPath string) (string, error) {
+// Cuts the given pump audio to the part where the music plays, returning the path of the result
+// and where it starts in the given audio, in seconds.
+// The delimiter match is also returned, or nil if the file did not match any delimiter.
+func focusAndTrimPumpAudio(ctx context.Context, foregroundPath string, locator Locator, delimiters *Delimiters, workers int) (string, float64, *FocusSuccess, error) {
 
-	log.Println("Checking if foreground audio needs a cut...")
+	logger := loggerFrom(ctx)
 
-	match, err := focusAudio(foregroundPath)
+	match, err := focusAudio(ctx, foregroundPath, locator, delimiters, workers)
 
 	if err != nil {
 		focusFail, ok := err.(FocusFail)
 		if !ok {
-			log.Println("error while trying to focus:", err)
-			return "", err
+			logger.Error("failed to detect delimiters", "err", err)
+			return "", 0, nil, err
 		}
 
-		log.Println("file did not match with known delimiters")
-		log.Println("scores:", focusFail.attempts)
+		logger.Info("chart audio did not match any delimiter", "attempts", focusFail.Attempts)
+	} else {
+		logger.Info("chart audio matched delimiter", "delimiter", match.Identifier, "start_score", match.StartScore, "end_score", match.EndScore)
+	}
 
-		result, err := trimAudioSilence(foregroundPath)
+	result, start, err := trimFocusedAudio(ctx, foregroundPath, match)
 
-		if err != nil {
-			return "", err
-		}
+	if err != nil {
+		return "", 0, nil, err
+	}
 
-		return result, nil
+	return result, start, match, nil
+}
 
-	} else {
-		log.Printf("file matched delimiter %s (%f, %f)!\n", match.Identifier, match.StartScore, match.EndScore)
+// Trims the given pump audio to the range of the given delimiter match (or to the whole audio if match is nil),
+// without the silence around it. Returns the path of the result, and where it starts in the given audio.
+func trimFocusedAudio(ctx context.Context, path string, match *FocusSuccess) (string, float64, error) {
 
-		log.Printf("performing cut to range (%f:%f)\n", match.LeftCut, match.RightCut)
+	from, to := 0.0, math.Inf(1)
 
-		cutted, err := cutAudio(foregroundPath, match.LeftCut, match.RightCut)
+	if match != nil {
+		from, to = match.LeftCut, match.RightCut
+	}
 
-		if err != nil {
-			return "", err
-		}
+	start, end, err := findAudibleRange(path, from, to)
 
-		defer func() {
-			if err != nil {
-				os.Remove(cutted)
-			}
-		}()
+	if err != nil {
+		return "", 0, err
+	}
 
-		trimmed, err := trimAudioSilence(cutted)
+	loggerFrom(ctx).Info("cutting chart audio", "from", start, "to", end)
 
-		if err != nil {
-			return "", err
-		}
+	result, err := cutAudio(ctx, "trim_audio", path, start, end)
 
-		return trimmed, err
+	if err != nil {
+		return "", 0, err
 	}
-}
 
-func getFileDuration(path string) (float64, error) {
+	return result, start, nil
+}
 
-	log.Printf("Getting duration of '%s'", path)
+func getFileDuration(ctx context.Context, path string) (float64, error) {
 
-	cmd := newCommand("ffprobe", "-i", path, "-show_entries", "format=duration", "-of", "csv=p=0")
-	log.Println("running ffprobe")
+	cmd := newCommand(ctx, "probe_duration", "ffprobe", "-i", path, "-show_entries", "format=duration", "-of", "csv=p=0")
 
 	stdout, err := cmd.Output()
 
 	if err != nil {
-		log.Println("failed to run ffprobe to get file duration")
 		return 0, err
 	}
 
@@ -293,9 +311,9 @@ func getFileDuration(path string) (float64, error) {
 	return result, nil
 }
 
-func overwriteAudioSegment(foregroundPath string, backgroundPath string, offset float64) (string, error) {
+func overwriteAudioSegment(ctx context.Context, foregroundPath string, backgroundPath string, offset float64) (string, error) {
 
-	foregroundDuration, err := getFileDuration(foregroundPath)
+	foregroundDuration, err := getFileDuration(ctx, foregroundPath)
 
 	if err != nil {
 		return "", err
@@ -329,6 +347,8 @@ func overwriteAudioSegment(foregroundPath string, backgroundPath string, offset
 	)
 
 	cmd := newCommand(
+		ctx,
+		"mix_audio",
 		"ffmpeg",
 		"-y",              // don't ask for overwrite confirmation
 		"-filter_complex", // use the following filter graph
@@ -338,23 +358,47 @@ func overwriteAudioSegment(foregroundPath string, backgroundPath string, offset
 		"-map", "[result]", // use cable `result` to write to output
 		outputPath)
 
-	log.Println("running ffmpeg to overwrite bg audio with fg audio")
-	log.Println("offset: ", offset)
-	log.Println("fgduration", foregroundDuration)
+	loggerFrom(ctx).Info("mixing chart audio into gameplay audio", "offset", offset, "chart_duration", foregroundDuration)
 
 	err = cmd.Run()
 
 	if err != nil {
-		log.Println("failed to run overwite ffmpeg")
-		return "", nil
+		return "", err
 	}
 
 	return outputPath, nil
 }
 
-func downloadYoutubeVideo(link string) (string, error) {
+// downloads the video through the cache when possible, release must be called once the video is not needed anymore
+func fetchYoutubeVideo(ctx context.Context, cache *YoutubeCache, link string) (path string, release func(), err error) {
+
+	if cache != nil {
+		id, err := youtubeVideoId(link)
+
+		if err == nil {
+			return cache.Fetch(ctx, id)
+		}
+
+		loggerFrom(ctx).Warn("not caching youtube video", "err", err)
+	}
+
+	path, err = downloadYoutubeVideo(ctx, link)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	return path, func() { os.Remove(path) }, nil
+}
+
+func downloadYoutubeVideo(ctx context.Context, link string) (string, error) {
+	return downloadYoutubeVideoTo(ctx, link, "", "pumpsync_*_yt_dlp")
+}
+
+// downloads the video to a new file in dir, named after pattern (like os.CreateTemp)
+func downloadYoutubeVideoTo(ctx context.Context, link string, dir string, pattern string) (string, error) {
 
-	outputFile, err := os.CreateTemp("", "pumpsync_*_yt_dlp.mp4")
+	outputFile, err := os.CreateTemp(dir, pattern+"."+youtubeFormat)
 
 	if err != nil {
 		return "", err
@@ -363,6 +407,8 @@ func downloadYoutubeVideo(link string) (string, error) {
 	defer func() {
 		if err != nil {
 			os.Remove(outputFile.Name())
+			// yt-dlp leaves this behind when it is interrupted
+			os.Remove(outputFile.Name() + ".part")
 		}
 	}()
 
@@ -370,14 +416,12 @@ func downloadYoutubeVideo(link string) (string, error) {
 
 	outputPath := outputFile.Name()
 
-	cmd := newCommand("yt-dlp", link, "-f", "mp4",
+	cmd := newCommand(ctx, "youtube_download", "yt-dlp", link, "-f", youtubeFormat,
 		"--force-overwrites",
 		"--max-filesize", "512M",
 		"--no-playlist",
 		"-o", outputPath)
 
-	log.Println("running yt-dlp")
-
 	err = cmd.Run()
 
 	if err != nil {
@@ -387,7 +431,10 @@ func downloadYoutubeVideo(link string) (string, error) {
 	return outputPath, nil
 }
 
-func extractAudioFromVideo(videoPath string) (string, error) {
+// the sample rate of the audio returned by extractAudioFromVideo
+const extractedSampleRate = 44100
+
+func extractAudioFromVideo(ctx context.Context, videoPath string) (string, error) {
 
 	audioFile, err := os.CreateTemp("", "pumpsync_vid_*.wav")
 
@@ -403,15 +450,13 @@ func extractAudioFromVideo(videoPath string) (string, error) {
 
 	audioFile.Close()
 
-	cmd := newCommand("ffmpeg",
+	cmd := newCommand(ctx, "extract_audio", "ffmpeg",
 		"-y",
 		"-i", videoPath,
-		"-ar", "44100",
-        "-ac", "1",
+		"-ar", strconv.Itoa(extractedSampleRate),
+		"-ac", "1",
 		audioFile.Name())
 
-	log.Println("running ffmpeg to convert video to audio")
-
 	err = cmd.Run()
 
 	if err != nil {
@@ -421,22 +466,19 @@ func extractAudioFromVideo(videoPath string) (string, error) {
 	return audioFile.Name(), nil
 }
 
+func overwriteVideoAudio(ctx context.Context, videoPath string, audioPath string, resultPath string) error {
 
-func overwriteVideoAudio(videoPath string, audioPath string, resultPath string) error {
-
-	cmd := newCommand("ffmpeg",
+	cmd := newCommand(ctx, "mux_video", "ffmpeg",
 		"-y",
 		"-i", videoPath,
 		"-i", audioPath,
 		"-map", "0:v",
 		"-map", "1:0",
 		"-f", "mp4",
-        "-c:v", "copy",
-        "-c:a", "aac",
+		"-c:v", "copy",
+		"-c:a", "aac",
 		resultPath)
 
-	log.Println("running ffmpeg to overwrite video audio")
-
 	err := cmd.Run()
 
 	if err != nil {
@@ -446,66 +488,299 @@ func overwriteVideoAudio(videoPath string, audioPath string, resultPath string)
 	return nil
 }
 
+type AudioFormat string
+
+const (
+	AudioFormatM4a  AudioFormat = "m4a"
+	AudioFormatFlac AudioFormat = "flac"
+	AudioFormatWav  AudioFormat = "wav"
+)
+
+// the ffmpeg muxer and codec arguments for each audio format
+var audioEncoders = map[AudioFormat][]string{
+	AudioFormatM4a:  {"-f", "ipod", "-c:a", "aac"},
+	AudioFormatFlac: {"-f", "flac", "-c:a", "flac"},
+	AudioFormatWav:  {"-f", "wav", "-c:a", "pcm_s16le"},
+}
+
+var UnsupportedAudioFormatError = errors.New("unsupported audio format")
+
+func (f AudioFormat) Validate() error {
+	if _, ok := audioEncoders[f]; !ok {
+		return fmt.Errorf("[%w] %q", UnsupportedAudioFormatError, f)
+	}
+
+	return nil
+}
+
+// Encodes the audio in audioPath to resultPath with the given format.
+func encodeAudio(ctx context.Context, audioPath string, resultPath string, format AudioFormat) error {
+
+	args := []string{"-y", "-i", audioPath, "-map", "0:a"}
+	args = append(args, audioEncoders[format]...)
+	args = append(args, resultPath)
+
+	return newCommand(ctx, "encode_audio", "ffmpeg", args...).Run()
+}
+
+// the x and y expressions for the overlay filter, for each overlay position
+var overlayPositions = map[string][2]string{
+	"top_left":     {"main_w*0.02", "main_h*0.02"},
+	"top_right":    {"main_w-overlay_w-main_w*0.02", "main_h*0.02"},
+	"bottom_left":  {"main_w*0.02", "main_h-overlay_h-main_h*0.02"},
+	"bottom_right": {"main_w-overlay_w-main_w*0.02", "main_h-overlay_h-main_h*0.02"},
+}
+
+type OverlayOptions struct {
+	Position string  // top_left || top_right || bottom_left || bottom_right
+	Scale    float64 // width of the chart video relative to the gameplay video, in (0, 1]
+	Opacity  float64 // in (0, 1]
+}
+
+var DefaultOverlayOptions = OverlayOptions{Position: "bottom_right", Scale: 0.3, Opacity: 1}
+
+var InvalidOverlayError = errors.New("invalid overlay options")
+
+func (o OverlayOptions) Validate() error {
+	if _, ok := overlayPositions[o.Position]; !ok {
+		return fmt.Errorf("[%w] unknown position %q", InvalidOverlayError, o.Position)
+	}
+
+	if o.Scale <= 0 || o.Scale > 1 {
+		return fmt.Errorf("[%w] scale must be in (0, 1]", InvalidOverlayError)
+	}
+
+	if o.Opacity <= 0 || o.Opacity > 1 {
+		return fmt.Errorf("[%w] opacity must be in (0, 1]", InvalidOverlayError)
+	}
+
+	return nil
+}
+
+// Composites the segment of the chart video which starts at chartStart and lasts for duration seconds
+// on top of the gameplay video, starting at offset, and uses the audio in audioPath for the result.
+func overlayChartVideo(ctx context.Context, videoPath string, chartPath string, audioPath string, resultPath string,
+	chartStart float64, duration float64, offset float64, overlay OverlayOptions) error {
+
+	position := overlayPositions[overlay.Position]
+
+	filterGraph := fmt.Sprintf(
+		`
+         [1:v]trim=start=%f:duration=%f,setpts=PTS-STARTPTS+%f/TB[cut];
+         [cut][0:v]scale2ref=w=iw*%f:h=ow/mdar[scaled][gameplay];
+         [scaled]format=yuva420p,colorchannelmixer=aa=%f[chart];
+         [gameplay][chart]overlay=x=%s:y=%s:eof_action=pass[video]
+         `,
+		chartStart,
+		duration,
+		offset,
+		overlay.Scale,
+		overlay.Opacity,
+		position[0],
+		position[1],
+	)
+
+	cmd := newCommand(ctx, "overlay_video", "ffmpeg",
+		"-y",
+		"-i", videoPath,
+		"-i", chartPath,
+		"-i", audioPath,
+		"-filter_complex", filterGraph,
+		"-map", "[video]",
+		"-map", "2:0",
+		"-f", "mp4",
+		"-c:a", "aac",
+		resultPath)
+
+	loggerFrom(ctx).Info("overlaying chart video", "chart_start", chartStart, "duration", duration, "offset", offset)
+
+	return cmd.Run()
+}
+
 var TooLowScoreError = errors.New("audio match score was too low")
 
 var DownloadError = errors.New("video download failed")
 
-func ImproveAudio(backgroundVideoPath string, youtubeLink string) (string, error) {
+type EditResult struct {
+	Path string // path of the edited video, or audio for KindOverwriteAudio, with the extension of its format
+
+	Match *FocusSuccess // nil if the youtube video did not match any known delimiter
+
+	Offset float64 // where the music starts in the gameplay video, in seconds
+	Score  float64 // confidence on the offset
+}
+
+type Kind string
+
+const (
+	KindOverwriteVideo Kind = "overwrite_video" // replaces the audio of the gameplay video
+	KindOverlayVideo   Kind = "overlay_video"   // also shows the chart video on top of the gameplay video
+	KindOverwriteAudio Kind = "overwrite_audio" // only returns the audio of the gameplay video, with the music replaced
+)
+
+type Options struct {
+	Locator Locator // defaults to NativeLocator
+
+	Kind Kind // defaults to KindOverwriteVideo
+
+	// how the chart video is shown, for KindOverlayVideo
+	Overlay OverlayOptions
+
+	// the format of the result for KindOverwriteAudio, defaults to AudioFormatM4a
+	AudioFormat AudioFormat
 
-	foregroundVideoPath, err := downloadYoutubeVideo(youtubeLink)
+	// the game delimiters looked for in the youtube video, see LoadDelimiters
+	Delimiters *Delimiters
+
+	// how many delimiters may be located at the same time, defaults to DEFAULT_FOCUS_WORKERS
+	FocusWorkers int
+
+	// the minimum score of the music in the gameplay video (see MINIMUM_FINAL_MATCH_SCORE), zero accepts any match
+	MinimumScore float64
+
+	// where youtube videos are downloaded to, may be nil
+	Cache *YoutubeCache
+
+	// the edit is cancelled if it takes longer than this, if not zero
+	Timeout time.Duration
+
+	// called whenever the pipeline moves on to another stage, may be nil
+	Progress func(ProgressEvent)
+
+	// used for every log of the edit (e.g with the id of the job), the default logger if nil
+	Logger *slog.Logger
+}
+
+// Replaces the audio of the gameplay video with the audio of the youtube video, and returns the path of the result.
+// Every command run by the edit is killed when ctx is done, and every temporary file is removed.
+func ImproveAudio(ctx context.Context, backgroundVideoPath string, youtubeLink string, options Options) (*EditResult, error) {
+
+	if options.Logger != nil {
+		ctx = WithLogger(ctx, options.Logger)
+	}
+
+	if options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+		defer cancel()
+	}
+
+	result, err := improveAudio(ctx, backgroundVideoPath, youtubeLink, options)
+
+	// killed commands only tell us they were killed, so we make sure
+	// callers can tell the edit was cancelled
+	if err != nil && ctx.Err() != nil && !errors.Is(err, ctx.Err()) {
+		err = fmt.Errorf("[%w] %w", ctx.Err(), err)
+	}
+
+	return result, err
+}
+
+func improveAudio(ctx context.Context, backgroundVideoPath string, youtubeLink string, options Options) (*EditResult, error) {
+
+	locator := options.Locator
+
+	if locator == nil {
+		locator = NativeLocator{}
+	}
+
+	if options.Kind == KindOverlayVideo {
+		if err := options.Overlay.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	extension := "mp4"
+
+	if options.Kind == KindOverwriteAudio {
+		if options.AudioFormat == "" {
+			options.AudioFormat = AudioFormatM4a
+		}
+
+		if err := options.AudioFormat.Validate(); err != nil {
+			return nil, err
+		}
+
+		extension = string(options.AudioFormat)
+	}
+
+	progress := newProgressTracker(options.Progress)
+
+	progress.enter(StageDownloading)
+
+	foregroundVideoPath, releaseForegroundVideo, err := fetchYoutubeVideo(ctx, options.Cache, youtubeLink)
 
 	if err != nil {
-		return "", fmt.Errorf("[%w] %w", DownloadError, err)
+		return nil, fmt.Errorf("[%w] %w", DownloadError, err)
 	}
 
-	defer os.Remove(foregroundVideoPath)
+	defer releaseForegroundVideo()
+
+	progress.enter(StageExtractingAudio)
 
-	backgroundAudioPath, err := extractAudioFromVideo(backgroundVideoPath)
+	backgroundAudioPath, err := extractAudioFromVideo(ctx, backgroundVideoPath)
 
 	defer os.Remove(backgroundAudioPath)
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	foregroundAudioPath, err := extractAudioFromVideo(foregroundVideoPath)
+	foregroundAudioPath, err := extractAudioFromVideo(ctx, foregroundVideoPath)
 
 	defer os.Remove(foregroundAudioPath)
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	trimmedForegroundAudioPath, err := focusAndTrimPumpAudio(foregroundAudioPath)
+	progress.enter(StageDetectingDelimiters)
+
+	trimmedForegroundAudioPath, chartStart, match, err := focusAndTrimPumpAudio(ctx, foregroundAudioPath, locator, options.Delimiters, options.FocusWorkers)
 
 	defer os.Remove(trimmedForegroundAudioPath)
 
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	delimiter := NoDelimiter
+
+	if match != nil {
+		delimiter = match.Identifier
 	}
 
-	offset, score, err := locateAudio(backgroundAudioPath, trimmedForegroundAudioPath)
+	progress.report(StageDetectingDelimiters, delimiter)
+
+	progress.enter(StageLocating)
+
+	offset, score, err := locateAudio(ctx, locator, backgroundAudioPath, trimmedForegroundAudioPath)
+
+	if err != nil {
+		return nil, err
+	}
 
-    if err != nil {
-        return "", err
-    }
+	// including the scores which are too low, to tell where the minimum should be
+	finalScore.Observe(score, delimiter)
 
-	if score < MINIMUM_FINAL_MATCH_SCORE {
-		return "", fmt.Errorf("[%w] %f", TooLowScoreError, score)
+	if score < options.MinimumScore {
+		return nil, fmt.Errorf("[%w] %f", TooLowScoreError, score)
 	}
 
-	finalAudio, err := overwriteAudioSegment(trimmedForegroundAudioPath, backgroundAudioPath, offset)
+	progress.enter(StageMixing)
 
-    if err != nil {
-        return "", err
-    }
+	finalAudio, err := overwriteAudioSegment(ctx, trimmedForegroundAudioPath, backgroundAudioPath, offset)
+
+	if err != nil {
+		return nil, err
+	}
 
 	defer os.Remove(finalAudio)
 
-	outputFile, err := os.CreateTemp("", "pumpsync_result_*.mp4")
+	outputFile, err := os.CreateTemp("", "pumpsync_result_*."+extension)
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	outputFilePath := outputFile.Name()
@@ -518,11 +793,28 @@ func ImproveAudio(backgroundVideoPath string, youtubeLink string) (string, error
 		}
 	}()
 
-	err = overwriteVideoAudio(backgroundVideoPath, finalAudio, outputFilePath)
+	progress.enter(StageMuxing)
+
+	if options.Kind == KindOverwriteAudio {
+		err = encodeAudio(ctx, finalAudio, outputFilePath, options.AudioFormat)
+	} else if options.Kind == KindOverlayVideo {
+		var duration float64
+
+		duration, err = getFileDuration(ctx, trimmedForegroundAudioPath)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = overlayChartVideo(ctx, backgroundVideoPath, foregroundVideoPath, finalAudio, outputFilePath,
+			chartStart, duration, offset, options.Overlay)
+	} else {
+		err = overwriteVideoAudio(ctx, backgroundVideoPath, finalAudio, outputFilePath)
+	}
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return outputFilePath, nil
+	return &EditResult{outputFilePath, match, offset, score}, nil
 }
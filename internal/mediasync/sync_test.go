@@ -0,0 +1,55 @@
+package mediasync
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFindAudibleRange(t *testing.T) {
+
+	const sampleRate = 1000
+
+	// 16 bit samples, so -30dB is about 1036
+	samples := make([]float64, sampleRate*4)
+
+	for i := range samples {
+		samples[i] = 500 // quiet, but not digital silence
+	}
+
+	for i := 1200; i < 1800; i++ {
+		samples[i] = 20000
+	}
+
+	samples[2500] = -3000
+
+	path := writeTempFile(t, "audio.wav", buildWav(t, wavSpec{format: wavFormatPCM, channels: 1, sampleRate: sampleRate, bitsPerSample: 16}, samples))
+
+	tests := []struct {
+		name     string
+		from, to float64
+		start    float64
+		end      float64
+	}{
+		{"whole audio", 0, 100, 1.2, 2.501},
+		{"within a cut", 1.5, 2.2, 1.5, 1.8},
+		{"silent cut", 3, 3.5, 3, 3.5},
+		{"silent cut past the end", 3, 100, 3, 4},
+		{"no cut", 0, math.Inf(1), 1.2, 2.501},
+		{"silent end without a cut", 3, math.Inf(1), 3, 4},
+		{"cut past the end", 10, math.Inf(1), 4, 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start, end, err := findAudibleRange(path, test.from, test.to)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if start != test.start || end != test.end {
+				t.Fatalf("expected %v-%v, got %v-%v", test.start, test.end, start, end)
+			}
+		})
+	}
+}
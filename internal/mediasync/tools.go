@@ -0,0 +1,53 @@
+package mediasync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Exported versions of the pipeline steps, so they can be run in isolation
+// (e.g by the `pumpsync locate` and `pumpsync focus` commands) to diagnose bad syncs.
+
+// Runs the program with the given flag (e.g `ffmpeg -version`) as the version_check stage, and returns what it printed.
+// When it fails, the first line it wrote to stderr is added to the error.
+func ProgramVersion(ctx context.Context, name string, flag string) ([]byte, error) {
+
+	cmd := newCommand(ctx, "version_check", name, flag)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+
+	if err != nil && stderr.Len() > 0 {
+		line, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n")
+		return nil, fmt.Errorf("%w: %s", err, line)
+	}
+
+	return output, err
+}
+
+// Converts the audio of the given media file to a mono 44.1k .wav file, and returns its path.
+func ExtractAudio(ctx context.Context, path string) (string, error) {
+	return extractAudioFromVideo(ctx, path)
+}
+
+// Locates needlePath in haystackPath, both must be files returned by ExtractAudio.
+func LocateAudio(ctx context.Context, locator Locator, haystackPath string, needlePath string) (LocateResult, error) {
+	return locator.Locate(ctx, haystackPath, needlePath)
+}
+
+// Tries to find the start and end of music delimiters of each pack in the given audio file.
+// Returns a FocusFail error with the scores of each attempt if none matched.
+func FocusAudio(ctx context.Context, path string, locator Locator, delimiters *Delimiters, workers int) (*FocusSuccess, error) {
+	return focusAudio(ctx, path, locator, delimiters, workers)
+}
+
+// Trims the given audio file with the result of FocusAudio, which may be nil,
+// and returns the path of the trimmed file.
+func TrimFocusedAudio(ctx context.Context, path string, match *FocusSuccess) (string, error) {
+	result, _, err := trimFocusedAudio(ctx, path, match)
+	return result, err
+}
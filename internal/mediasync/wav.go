@@ -0,0 +1,223 @@
+package mediasync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// minimal reader for the .wav files produced by ffmpeg in this package,
+// it supports integer PCM and IEEE float samples, in either plain or extensible format.
+
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+)
+
+var UnsupportedWavError = errors.New("unsupported wav file")
+
+type wavReader struct {
+	file *os.File
+	data *bufio.Reader
+
+	Format        uint16
+	Channels      int
+	SampleRate    int
+	BitsPerSample int
+
+	// number of samples (per channel) in the data chunk
+	SampleCount int
+}
+
+func openWav(path string) (*wavReader, error) {
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &wavReader{file: file}
+
+	err = reader.readHeader()
+
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return reader, nil
+}
+
+func (r *wavReader) Close() error {
+	return r.file.Close()
+}
+
+func (r *wavReader) readHeader() error {
+
+	input := bufio.NewReader(r.file)
+
+	var riff [12]byte
+
+	if _, err := io.ReadFull(input, riff[:]); err != nil {
+		return err
+	}
+
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return fmt.Errorf("[%w] missing RIFF/WAVE header", UnsupportedWavError)
+	}
+
+	foundFormat := false
+
+	for {
+		var header [8]byte
+
+		if _, err := io.ReadFull(input, header[:]); err != nil {
+			return fmt.Errorf("[%w] missing data chunk: %w", UnsupportedWavError, err)
+		}
+
+		id := string(header[0:4])
+		size := int64(binary.LittleEndian.Uint32(header[4:8]))
+
+		switch id {
+		case "fmt ":
+			chunk := make([]byte, size)
+
+			if _, err := io.ReadFull(input, chunk); err != nil {
+				return err
+			}
+
+			if err := r.parseFormat(chunk); err != nil {
+				return err
+			}
+
+			if size%2 == 1 {
+				if _, err := input.Discard(1); err != nil {
+					return err
+				}
+			}
+
+			foundFormat = true
+
+		case "data":
+			if !foundFormat {
+				return fmt.Errorf("[%w] data chunk before fmt chunk", UnsupportedWavError)
+			}
+
+			blockAlign := int64(r.Channels * r.BitsPerSample / 8)
+
+			// ffmpeg leaves the size as 0xFFFFFFFF when it can't seek back,
+			// in that case we just read until the end of the file.
+			if size == math.MaxUint32 {
+				info, err := r.file.Stat()
+
+				if err != nil {
+					return err
+				}
+
+				position, err := r.file.Seek(0, io.SeekCurrent)
+
+				if err != nil {
+					return err
+				}
+
+				size = info.Size() - (position - int64(input.Buffered()))
+			}
+
+			r.SampleCount = int(size / blockAlign)
+			r.data = input
+
+			return nil
+
+		default:
+			// chunks are word aligned
+			if _, err := input.Discard(int(size + size%2)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (r *wavReader) parseFormat(chunk []byte) error {
+
+	if len(chunk) < 16 {
+		return fmt.Errorf("[%w] fmt chunk too small", UnsupportedWavError)
+	}
+
+	r.Format = binary.LittleEndian.Uint16(chunk[0:2])
+	r.Channels = int(binary.LittleEndian.Uint16(chunk[2:4]))
+	r.SampleRate = int(binary.LittleEndian.Uint32(chunk[4:8]))
+	r.BitsPerSample = int(binary.LittleEndian.Uint16(chunk[14:16]))
+
+	if r.Format == wavFormatExtensible {
+		if len(chunk) < 26 {
+			return fmt.Errorf("[%w] extensible fmt chunk too small", UnsupportedWavError)
+		}
+
+		// the first two bytes of the sub format GUID hold the actual format
+		r.Format = binary.LittleEndian.Uint16(chunk[24:26])
+	}
+
+	if r.Channels < 1 || r.SampleRate < 1 {
+		return fmt.Errorf("[%w] invalid channel count or sample rate", UnsupportedWavError)
+	}
+
+	switch {
+	case r.Format == wavFormatPCM && (r.BitsPerSample == 8 || r.BitsPerSample == 16 || r.BitsPerSample == 24 || r.BitsPerSample == 32):
+	case r.Format == wavFormatFloat && (r.BitsPerSample == 32 || r.BitsPerSample == 64):
+	default:
+		return fmt.Errorf("[%w] format %d with %d bits per sample", UnsupportedWavError, r.Format, r.BitsPerSample)
+	}
+
+	return nil
+}
+
+// Reads the next sample of the file.
+// Integer samples are not normalized, just like the hound crate does in the rust locate program.
+func (r *wavReader) readSample() (float32, error) {
+
+	var buffer [8]byte
+
+	size := r.BitsPerSample / 8
+
+	if _, err := io.ReadFull(r.data, buffer[:size]); err != nil {
+		return 0, err
+	}
+
+	if r.Format == wavFormatFloat {
+		if size == 4 {
+			return math.Float32frombits(binary.LittleEndian.Uint32(buffer[:4])), nil
+		}
+
+		return float32(math.Float64frombits(binary.LittleEndian.Uint64(buffer[:8]))), nil
+	}
+
+	switch size {
+	case 1:
+		// 8 bit wav samples are unsigned
+		return float32(int32(buffer[0]) - 128), nil
+	case 2:
+		return float32(int16(binary.LittleEndian.Uint16(buffer[:2]))), nil
+	case 3:
+		value := int32(buffer[0]) | int32(buffer[1])<<8 | int32(buffer[2])<<16
+		// sign extension
+		value = (value << 8) >> 8
+		return float32(value), nil
+	default:
+		return float32(int32(binary.LittleEndian.Uint32(buffer[:4]))), nil
+	}
+}
+
+// the magnitude of the loudest samples of the file, as returned by readSample
+func (r *wavReader) fullScale() float64 {
+	if r.Format == wavFormatFloat {
+		return 1
+	}
+
+	return math.Exp2(float64(r.BitsPerSample - 1))
+}
@@ -0,0 +1,227 @@
+package mediasync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type wavSpec struct {
+	format        uint16 // written in the fmt chunk, the sub format goes in the GUID when extensible
+	subFormat     uint16
+	channels      int
+	sampleRate    int
+	bitsPerSample int
+
+	unknownDataSize bool   // writes 0xFFFFFFFF as the size of the data chunk, like ffmpeg does when streaming
+	extraChunk      []byte // written before the data chunk, in a chunk with an odd size if its length is odd
+}
+
+// builds a wav file with the given samples, which are encoded with the format of spec
+func buildWav(t *testing.T, spec wavSpec, samples []float64) []byte {
+	t.Helper()
+
+	var data bytes.Buffer
+
+	for _, sample := range samples {
+		switch {
+		case spec.subFormatOrFormat() == wavFormatFloat && spec.bitsPerSample == 32:
+			binary.Write(&data, binary.LittleEndian, math.Float32bits(float32(sample)))
+		case spec.subFormatOrFormat() == wavFormatFloat:
+			binary.Write(&data, binary.LittleEndian, math.Float64bits(sample))
+		case spec.bitsPerSample == 8:
+			data.WriteByte(byte(int(sample) + 128))
+		case spec.bitsPerSample == 16:
+			binary.Write(&data, binary.LittleEndian, int16(sample))
+		case spec.bitsPerSample == 24:
+			value := int32(sample)
+			data.Write([]byte{byte(value), byte(value >> 8), byte(value >> 16)})
+		default:
+			binary.Write(&data, binary.LittleEndian, int32(sample))
+		}
+	}
+
+	var format bytes.Buffer
+
+	blockAlign := spec.channels * spec.bitsPerSample / 8
+
+	binary.Write(&format, binary.LittleEndian, spec.format)
+	binary.Write(&format, binary.LittleEndian, uint16(spec.channels))
+	binary.Write(&format, binary.LittleEndian, uint32(spec.sampleRate))
+	binary.Write(&format, binary.LittleEndian, uint32(spec.sampleRate*blockAlign))
+	binary.Write(&format, binary.LittleEndian, uint16(blockAlign))
+	binary.Write(&format, binary.LittleEndian, uint16(spec.bitsPerSample))
+
+	if spec.format == wavFormatExtensible {
+		binary.Write(&format, binary.LittleEndian, uint16(22)) // extension size
+		binary.Write(&format, binary.LittleEndian, uint16(spec.bitsPerSample))
+		binary.Write(&format, binary.LittleEndian, uint32(0)) // channel mask
+		binary.Write(&format, binary.LittleEndian, spec.subFormat)
+		format.Write(make([]byte, 14)) // rest of the GUID
+	}
+
+	var body bytes.Buffer
+
+	body.WriteString("WAVE")
+	writeChunk(&body, "fmt ", format.Bytes(), uint32(format.Len()))
+
+	if spec.extraChunk != nil {
+		writeChunk(&body, "LIST", spec.extraChunk, uint32(len(spec.extraChunk)))
+	}
+
+	dataSize := uint32(data.Len())
+
+	if spec.unknownDataSize {
+		dataSize = math.MaxUint32
+	}
+
+	writeChunk(&body, "data", data.Bytes(), dataSize)
+
+	var file bytes.Buffer
+
+	file.WriteString("RIFF")
+	binary.Write(&file, binary.LittleEndian, uint32(body.Len()))
+	file.Write(body.Bytes())
+
+	return file.Bytes()
+}
+
+func (spec wavSpec) subFormatOrFormat() uint16 {
+	if spec.format == wavFormatExtensible {
+		return spec.subFormat
+	}
+
+	return spec.format
+}
+
+// chunks with odd sizes are followed by a padding byte
+func writeChunk(w *bytes.Buffer, id string, content []byte, size uint32) {
+	w.WriteString(id)
+	binary.Write(w, binary.LittleEndian, size)
+	w.Write(content)
+
+	if len(content)%2 == 1 {
+		w.WriteByte(0)
+	}
+}
+
+func writeTempFile(t *testing.T, name string, content []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestOpenWavFormats(t *testing.T) {
+
+	samples := []float64{0, 1, -1, 100, -100, 127, -128}
+
+	tests := []struct {
+		name string
+		spec wavSpec
+	}{
+		{"pcm 8", wavSpec{format: wavFormatPCM, bitsPerSample: 8}},
+		{"pcm 16", wavSpec{format: wavFormatPCM, bitsPerSample: 16}},
+		{"pcm 24", wavSpec{format: wavFormatPCM, bitsPerSample: 24}},
+		{"pcm 32", wavSpec{format: wavFormatPCM, bitsPerSample: 32}},
+		{"float 32", wavSpec{format: wavFormatFloat, bitsPerSample: 32}},
+		{"float 64", wavSpec{format: wavFormatFloat, bitsPerSample: 64}},
+		{"extensible pcm 16", wavSpec{format: wavFormatExtensible, subFormat: wavFormatPCM, bitsPerSample: 16}},
+		{"extensible float 32", wavSpec{format: wavFormatExtensible, subFormat: wavFormatFloat, bitsPerSample: 32}},
+		{"unknown data size", wavSpec{format: wavFormatPCM, bitsPerSample: 16, unknownDataSize: true}},
+		{"odd sized chunk", wavSpec{format: wavFormatPCM, bitsPerSample: 16, extraChunk: []byte("abc")}},
+		{"even sized chunk", wavSpec{format: wavFormatPCM, bitsPerSample: 24, extraChunk: []byte("abcd")}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.spec.channels = 1
+			test.spec.sampleRate = 44100
+
+			path := writeTempFile(t, "audio.wav", buildWav(t, test.spec, samples))
+
+			reader, err := openWav(path)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer reader.Close()
+
+			if reader.Channels != 1 || reader.SampleRate != 44100 || reader.BitsPerSample != test.spec.bitsPerSample {
+				t.Fatalf("got %d channels, %dHz and %d bits", reader.Channels, reader.SampleRate, reader.BitsPerSample)
+			}
+
+			if reader.SampleCount != len(samples) {
+				t.Fatalf("expected %d samples, got %d", len(samples), reader.SampleCount)
+			}
+
+			for i, expected := range samples {
+				sample, err := reader.readSample()
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if float64(sample) != expected {
+					t.Errorf("sample %d: expected %v, got %v", i, expected, sample)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenWavStereoSampleCount(t *testing.T) {
+
+	spec := wavSpec{format: wavFormatPCM, channels: 2, sampleRate: 8000, bitsPerSample: 16}
+
+	reader, err := openWav(writeTempFile(t, "stereo.wav", buildWav(t, spec, make([]float64, 10))))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer reader.Close()
+
+	if reader.SampleCount != 5 {
+		t.Fatalf("expected 5 samples per channel, got %d", reader.SampleCount)
+	}
+}
+
+func TestOpenWavRejectsUnsupported(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{"not riff", []byte("this is not a wav file at all")},
+		{"pcm 12", buildWav(t, wavSpec{format: wavFormatPCM, channels: 1, sampleRate: 8000, bitsPerSample: 12}, nil)},
+		{"float 16", buildWav(t, wavSpec{format: wavFormatFloat, channels: 1, sampleRate: 8000, bitsPerSample: 16}, nil)},
+		{"alaw", buildWav(t, wavSpec{format: 6, channels: 1, sampleRate: 8000, bitsPerSample: 8}, nil)},
+		{"no channels", buildWav(t, wavSpec{format: wavFormatPCM, channels: 0, sampleRate: 8000, bitsPerSample: 16}, nil)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := openWav(writeTempFile(t, "audio.wav", test.content))
+
+			if err == nil {
+				reader.Close()
+				t.Fatal("expected an error")
+			}
+
+			if !errors.Is(err, UnsupportedWavError) {
+				t.Fatalf("expected UnsupportedWavError, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package mediasync
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// the yt-dlp format we download youtube videos with
+const youtubeFormat = "mp4"
+
+// downloads that did not finish are written with this prefix, and removed on startup
+const cacheDownloadPrefix = "download_"
+
+// A YoutubeCache keeps downloaded youtube videos in a directory, so the same chart video
+// is only downloaded once. When the files get bigger than the size limit, the least recently
+// used ones are removed, except the ones still being used by an edit.
+type YoutubeCache struct {
+	dir      string
+	maxBytes int64
+
+	mutex    sync.Mutex
+	entries  map[string]*list.Element // of *cacheEntry
+	lru      *list.List               // most recently used first
+	size     int64
+	inflight map[string]*cacheDownload
+	stats    CacheStats
+}
+
+type cacheEntry struct {
+	key  string
+	path string
+	size int64
+	refs int
+}
+
+// a yt-dlp run shared by every edit asking for the same video
+type cacheDownload struct {
+	done    chan struct{}
+	entry   *cacheEntry
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+type CacheStats struct {
+	Hits      int64 // videos that were already in the cache
+	Misses    int64 // videos that had to be downloaded
+	Shared    int64 // requests that waited for a download started by another edit
+	Evictions int64
+	Entries   int
+	Bytes     int64
+}
+
+// Opens the cache in dir, creating it if needed, and loads the videos which are already there.
+func NewYoutubeCache(dir string, maxBytes int64) (*YoutubeCache, error) {
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	cache := &YoutubeCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		inflight: make(map[string]*cacheDownload),
+	}
+
+	files, err := os.ReadDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	type existing struct {
+		entry   *cacheEntry
+		modTime int64
+	}
+
+	var found []existing
+
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+
+		if strings.HasPrefix(file.Name(), cacheDownloadPrefix) {
+			os.Remove(path)
+			continue
+		}
+
+		info, err := file.Info()
+
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		entry := &cacheEntry{key: file.Name(), path: path, size: info.Size()}
+		found = append(found, existing{entry, info.ModTime().UnixNano()})
+	}
+
+	// the most recently modified files are considered the most recently used
+	sort.Slice(found, func(i, j int) bool { return found[i].modTime > found[j].modTime })
+
+	for _, file := range found {
+		cache.entries[file.entry.key] = cache.lru.PushBack(file.entry)
+		cache.size += file.entry.size
+	}
+
+	cache.mutex.Lock()
+	cache.evict()
+	cache.mutex.Unlock()
+
+	slog.Info("youtube cache loaded", "dir", dir, "entries", len(cache.entries), "bytes", cache.size)
+
+	return cache, nil
+}
+
+// Returns the path of the youtube video with the given id, downloading it if it is not in the cache.
+// The file is kept until release is called, and must not be modified.
+func (cache *YoutubeCache) Fetch(ctx context.Context, id string) (path string, release func(), err error) {
+
+	key := id + "." + youtubeFormat
+
+	cache.mutex.Lock()
+
+	if element, ok := cache.entries[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		entry.refs++
+		cache.lru.MoveToFront(element)
+		cache.stats.Hits++
+		youtubeCacheRequests.Inc("hit")
+		stats := cache.stats
+		cache.mutex.Unlock()
+
+		slog.Info("youtube cache hit", "id", id, "hits", stats.Hits, "misses", stats.Misses)
+
+		return entry.path, cache.releaser(entry), nil
+	}
+
+	download, ok := cache.inflight[key]
+
+	if ok {
+		cache.stats.Shared++
+		youtubeCacheRequests.Inc("shared")
+	} else {
+		cache.stats.Misses++
+		youtubeCacheRequests.Inc("miss")
+		download = cache.startDownload(key, id)
+	}
+
+	download.waiters++
+
+	stats := cache.stats
+	cache.mutex.Unlock()
+
+	slog.Info("youtube cache miss", "id", id, "shared", ok, "hits", stats.Hits, "misses", stats.Misses)
+
+	select {
+	case <-download.done:
+	case <-ctx.Done():
+		cache.mutex.Lock()
+		defer cache.mutex.Unlock()
+
+		select {
+		case <-download.done:
+			// the download finished in the meantime, so we give back our reference
+			if download.entry != nil {
+				download.entry.refs--
+				cache.evict()
+			}
+
+		default:
+			download.waiters--
+
+			// nobody else wants the video, so there is no point in finishing the download
+			if download.waiters == 0 {
+				download.cancel()
+				delete(cache.inflight, key)
+			}
+		}
+
+		return "", nil, ctx.Err()
+	}
+
+	if download.err != nil {
+		return "", nil, download.err
+	}
+
+	return download.entry.path, cache.releaser(download.entry), nil
+}
+
+// must be called with the mutex held
+func (cache *YoutubeCache) startDownload(key string, id string) *cacheDownload {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	download := &cacheDownload{done: make(chan struct{}), cancel: cancel}
+	cache.inflight[key] = download
+
+	go func() {
+		defer cancel()
+
+		link := fmt.Sprintf("http://youtube.com/watch?v=%s", id)
+
+		path, err := downloadYoutubeVideoTo(ctx, link, cache.dir, cacheDownloadPrefix+"*")
+
+		if err == nil {
+			finalPath := filepath.Join(cache.dir, key)
+			err = os.Rename(path, finalPath)
+
+			if err != nil {
+				os.Remove(path)
+			}
+
+			path = finalPath
+		}
+
+		var info os.FileInfo
+
+		if err == nil {
+			info, err = os.Stat(path)
+		}
+
+		cache.mutex.Lock()
+		defer cache.mutex.Unlock()
+
+		if cache.inflight[key] == download {
+			delete(cache.inflight, key)
+		}
+
+		if err != nil {
+			download.err = err
+			close(download.done)
+			return
+		}
+
+		// every waiter gets a reference to the entry
+		entry := &cacheEntry{key: key, path: path, size: info.Size(), refs: download.waiters}
+
+		cache.entries[key] = cache.lru.PushFront(entry)
+		cache.size += entry.size
+		cache.evict()
+
+		download.entry = entry
+		close(download.done)
+	}()
+
+	return download
+}
+
+func (cache *YoutubeCache) releaser(entry *cacheEntry) func() {
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			cache.mutex.Lock()
+			defer cache.mutex.Unlock()
+
+			entry.refs--
+			cache.evict()
+		})
+	}
+}
+
+// removes the least recently used videos until the cache fits its size limit,
+// must be called with the mutex held
+func (cache *YoutubeCache) evict() {
+	element := cache.lru.Back()
+
+	for cache.size > cache.maxBytes && element != nil {
+		previous := element.Prev()
+		entry := element.Value.(*cacheEntry)
+
+		if entry.refs == 0 {
+			cache.lru.Remove(element)
+			delete(cache.entries, entry.key)
+			cache.size -= entry.size
+			cache.stats.Evictions++
+			youtubeCacheEvictions.Inc()
+
+			os.Remove(entry.path)
+
+			slog.Info("youtube cache eviction", "key", entry.key, "bytes", entry.size)
+		}
+
+		element = previous
+	}
+}
+
+func (cache *YoutubeCache) Stats() CacheStats {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	stats := cache.stats
+	stats.Entries = len(cache.entries)
+	stats.Bytes = cache.size
+
+	return stats
+}
+
+var NotYoutubeLinkError = errors.New("not a youtube video link")
+
+// extracts the video id from youtube.com/watch?v=<id> and youtu.be/<id> links
+func youtubeVideoId(link string) (string, error) {
+
+	parsed, err := url.Parse(link)
+
+	if err != nil {
+		return "", err
+	}
+
+	var id string
+
+	host := strings.TrimPrefix(parsed.Hostname(), "www.")
+
+	switch host {
+	case "youtube.com", "m.youtube.com", "music.youtube.com":
+		id = parsed.Query().Get("v")
+	case "youtu.be":
+		id = strings.TrimPrefix(parsed.Path, "/")
+	}
+
+	if id == "" || !youtubeIdRegex.MatchString(id) {
+		return "", fmt.Errorf("[%w] %s", NotYoutubeLinkError, link)
+	}
+
+	return id, nil
+}
+
+var youtubeIdRegex = regexp.MustCompile(`^[a-zA-Z0-9\-\_]+$`)
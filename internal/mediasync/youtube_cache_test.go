@@ -0,0 +1,275 @@
+package mediasync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// puts a yt-dlp in PATH which writes a line to calls whenever it runs, and downloads
+// 100 bytes to its output (the last argument) once the returned gate file exists,
+// leaving a .part file while it waits
+func fakeYtDlpDownload(t *testing.T) (calls string, gate string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake yt-dlp is a shell script")
+	}
+
+	dir := t.TempDir()
+	calls = filepath.Join(dir, "calls")
+	gate = filepath.Join(dir, "gate")
+
+	script := "#!/bin/sh\n" +
+		"echo >> '" + calls + "'\n" +
+		"for out; do :; done\n" +
+		"echo partial > \"$out.part\"\n" +
+		"while [ ! -e '" + gate + "' ]; do sleep 0.01; done\n" +
+		"head -c 100 /dev/zero > \"$out\"\n" +
+		"rm \"$out.part\"\n"
+
+	if err := os.WriteFile(filepath.Join(dir, "yt-dlp"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	return calls, gate
+}
+
+func openGate(t *testing.T, gate string) {
+	if err := os.WriteFile(gate, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func downloadsIn(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), cacheDownloadPrefix) {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return names
+}
+
+func TestYoutubeCacheSharesDownloads(t *testing.T) {
+
+	calls, gate := fakeYtDlpDownload(t)
+
+	cache, err := NewYoutubeCache(t.TempDir(), 1000)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const requests = 8
+
+	var wg sync.WaitGroup
+	paths := make([]string, requests)
+
+	for i := range requests {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			path, release, err := cache.Fetch(context.Background(), "sharedvideo")
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			defer release()
+
+			paths[i] = path
+		}()
+	}
+
+	eventually(t, "every request to wait", func() bool {
+		stats := cache.Stats()
+		return stats.Misses+stats.Shared == requests
+	})
+
+	openGate(t, gate)
+	wg.Wait()
+
+	if n := countCalls(t, calls); n != 1 {
+		t.Errorf("yt-dlp ran %d times", n)
+	}
+
+	for _, path := range paths {
+		if path != paths[0] {
+			t.Errorf("got different paths %q and %q", path, paths[0])
+		}
+	}
+
+	// later requests are hits
+	_, release, err := cache.Fetch(context.Background(), "sharedvideo")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release()
+
+	if stats := cache.Stats(); stats.Misses != 1 || stats.Shared != requests-1 || stats.Hits != 1 || stats.Entries != 1 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestYoutubeCacheEvictionSkipsUsedVideos(t *testing.T) {
+
+	_, gate := fakeYtDlpDownload(t)
+	openGate(t, gate)
+
+	// fits two of the 100 byte videos
+	cache, err := NewYoutubeCache(t.TempDir(), 250)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetch := func(id string) (string, func()) {
+		path, release, err := cache.Fetch(context.Background(), id)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return path, release
+	}
+
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	first, releaseFirst := fetch("first")
+	second, releaseSecond := fetch("second")
+	releaseSecond()
+
+	// the first video is the least recently used, but it's still being used
+	third, releaseThird := fetch("third")
+
+	if !exists(first) || exists(second) || !exists(third) {
+		t.Fatalf("expected only the second video to be evicted")
+	}
+
+	releaseFirst()
+	releaseFirst() // releasing twice doesn't give back another reference
+
+	if stats := cache.Stats(); stats.Evictions != 1 || stats.Bytes != 200 {
+		t.Errorf("got %+v", stats)
+	}
+
+	_, releaseFourth := fetch("fourth")
+
+	if exists(first) || !exists(third) {
+		t.Errorf("expected the first video to be evicted once it was released")
+	}
+
+	releaseThird()
+	releaseFourth()
+
+	// every video is used, so the cache goes over its limit until they are released
+	_, releaseFifth := fetch("fifth")
+	_, releaseSixth := fetch("sixth")
+	_, releaseSeventh := fetch("seventh")
+
+	if stats := cache.Stats(); stats.Bytes != 300 {
+		t.Errorf("expected the used videos to be kept, got %+v", stats)
+	}
+
+	releaseFifth()
+
+	if stats := cache.Stats(); stats.Bytes != 200 || stats.Entries != 2 {
+		t.Errorf("expected the released video to be evicted, got %+v", stats)
+	}
+
+	releaseSixth()
+	releaseSeventh()
+}
+
+func TestYoutubeCacheCancelledDownload(t *testing.T) {
+
+	calls, gate := fakeYtDlpDownload(t)
+
+	dir := t.TempDir()
+
+	cache, err := NewYoutubeCache(dir, 1000)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	result := make(chan error)
+
+	go func() {
+		_, _, err := cache.Fetch(ctx, "cancelledvideo")
+		result <- err
+	}()
+
+	eventually(t, "the download to start", func() bool { return len(downloadsIn(t, dir)) > 0 })
+
+	cancel()
+
+	if err := <-result; !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+
+	cache.mutex.Lock()
+	inflight := len(cache.inflight)
+	cache.mutex.Unlock()
+
+	if inflight != 0 {
+		t.Errorf("%d downloads are still in flight", inflight)
+	}
+
+	// yt-dlp is killed, and its files removed
+	eventually(t, "the partial download to be removed", func() bool { return len(downloadsIn(t, dir)) == 0 })
+
+	// the next request downloads the video again
+	openGate(t, gate)
+
+	path, release, err := cache.Fetch(context.Background(), "cancelledvideo")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer release()
+
+	if filepath.Dir(path) != dir || countCalls(t, calls) != 2 {
+		t.Errorf("got %q after %d downloads", path, countCalls(t, calls))
+	}
+}
@@ -0,0 +1,233 @@
+package mediasync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chart videos are a song plus the game intro and outro, so anything
+// much longer than a few minutes is not a chart video
+const MAX_YOUTUBE_DURATION = 6 * time.Minute
+
+var YoutubeNotFoundError = errors.New("youtube video not found")
+var YoutubePrivateError = errors.New("youtube video is private")
+var YoutubeLiveError = errors.New("youtube video is a live stream")
+var YoutubeTooLongError = errors.New("youtube video is too long")
+
+// how long the metadata of a video is reused, the info endpoint and the edit
+// preflight usually ask for the same video within a few seconds of each other
+const YOUTUBE_INFO_TTL = 10 * time.Minute
+
+// how many yt-dlp metadata requests may run at once, the others wait for their turn
+const MAX_CONCURRENT_YOUTUBE_INFO = 4
+
+// yt-dlp error messages of videos that don't exist (or can't be watched from here),
+// and of videos that need an account which has access to them
+var youtubeNotFoundMessages = []string{
+	"Video unavailable",
+	"This video is not available",
+	"This video has been removed",
+	"The uploader has not made this video available in your country",
+	"Incomplete YouTube ID",
+	"HTTP Error 404",
+}
+
+var youtubePrivateMessages = []string{
+	"Private video",
+	"This video is private",
+	"This video is available to this channel's members",
+}
+
+type YoutubeInfo struct {
+	Id        string  `json:"id"`
+	Title     string  `json:"title"`
+	Duration  float64 `json:"duration"` // in seconds, zero for live streams
+	Thumbnail string  `json:"thumbnail"`
+
+	LiveStatus   string `json:"live_status"`  // not_live || is_live || is_upcoming || was_live || post_live
+	Availability string `json:"availability"` // public || unlisted || private || needs_auth || ...
+}
+
+type cachedYoutubeInfo struct {
+	info    *YoutubeInfo
+	err     error // only YoutubeNotFoundError and YoutubePrivateError are kept
+	expires time.Time
+}
+
+var (
+	youtubeInfoMutex sync.Mutex
+	youtubeInfoCache = make(map[string]cachedYoutubeInfo) // by video id
+	youtubeInfoSlots = make(chan struct{}, MAX_CONCURRENT_YOUTUBE_INFO)
+)
+
+// Fetches the metadata of the youtube video in link with yt-dlp, without downloading it.
+// Returns YoutubeNotFoundError or YoutubePrivateError if the video can't be seen.
+// The result is reused for YOUTUBE_INFO_TTL.
+func FetchYoutubeInfo(ctx context.Context, link string) (*YoutubeInfo, error) {
+
+	// links we can't get an id from are left for yt-dlp to reject
+	id, idErr := youtubeVideoId(link)
+
+	if idErr == nil {
+		if info, err, ok := cachedInfo(id); ok {
+			return info, err
+		}
+	}
+
+	select {
+	case youtubeInfoSlots <- struct{}{}:
+		defer func() { <-youtubeInfoSlots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// another request may have fetched it while we waited
+	if idErr == nil {
+		if info, err, ok := cachedInfo(id); ok {
+			return info, err
+		}
+	}
+
+	info, err := runYoutubeInfo(ctx, link)
+
+	if idErr == nil && (err == nil || errors.Is(err, YoutubeNotFoundError) || errors.Is(err, YoutubePrivateError)) {
+		storeInfo(id, info, err)
+	}
+
+	return info, err
+}
+
+// the cached metadata of the video, as a copy so callers can't change the cached one
+func cachedInfo(id string) (*YoutubeInfo, error, bool) {
+	youtubeInfoMutex.Lock()
+	defer youtubeInfoMutex.Unlock()
+
+	cached, ok := youtubeInfoCache[id]
+
+	if !ok || time.Now().After(cached.expires) {
+		return nil, nil, false
+	}
+
+	if cached.err != nil {
+		return nil, cached.err, true
+	}
+
+	info := *cached.info
+	return &info, nil, true
+}
+
+func storeInfo(id string, info *YoutubeInfo, err error) {
+	youtubeInfoMutex.Lock()
+	defer youtubeInfoMutex.Unlock()
+
+	now := time.Now()
+
+	for key, cached := range youtubeInfoCache {
+		if now.After(cached.expires) {
+			delete(youtubeInfoCache, key)
+		}
+	}
+
+	cached := cachedYoutubeInfo{err: err, expires: now.Add(YOUTUBE_INFO_TTL)}
+
+	if info != nil {
+		copied := *info
+		cached.info = &copied
+	}
+
+	youtubeInfoCache[id] = cached
+}
+
+func runYoutubeInfo(ctx context.Context, link string) (*YoutubeInfo, error) {
+
+	cmd := newCommand(ctx, "youtube_info", "yt-dlp", link, "--dump-single-json", "--no-playlist", "--no-warnings")
+
+	// we need the error message to tell why the video can't be seen
+	var stderr bytes.Buffer
+
+	if cmd.Stderr != nil {
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, &stderr)
+	} else {
+		cmd.Stderr = &stderr
+	}
+
+	stdout, err := cmd.Output()
+
+	if err != nil {
+		return nil, youtubeInfoError(err, stderr.String())
+	}
+
+	var info YoutubeInfo
+
+	if err = json.Unmarshal(stdout, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// tells why yt-dlp couldn't fetch the metadata of a video from its error message
+func youtubeInfoError(err error, message string) error {
+
+	message = strings.TrimSpace(message)
+
+	// private is checked first, as yt-dlp also says "Video unavailable" for them
+	if containsAny(message, youtubePrivateMessages) {
+		return fmt.Errorf("[%w] %s", YoutubePrivateError, message)
+	}
+
+	if containsAny(message, youtubeNotFoundMessages) {
+		return fmt.Errorf("[%w] %s", YoutubeNotFoundError, message)
+	}
+
+	return fmt.Errorf("yt-dlp failed: %w: %s", err, message)
+}
+
+func containsAny(message string, substrings []string) bool {
+	for _, substring := range substrings {
+		if strings.Contains(message, substring) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks if the video can be used in an edit, returning YoutubePrivateError,
+// YoutubeLiveError or YoutubeTooLongError (if it is longer than maxDuration) if it can't.
+func (info *YoutubeInfo) Check(maxDuration time.Duration) error {
+
+	if info.Availability == "private" || info.Availability == "needs_auth" ||
+		info.Availability == "premium_only" || info.Availability == "subscriber_only" {
+		return fmt.Errorf("[%w] availability is %s", YoutubePrivateError, info.Availability)
+	}
+
+	if info.LiveStatus == "is_live" || info.LiveStatus == "is_upcoming" || info.LiveStatus == "post_live" {
+		return fmt.Errorf("[%w] live status is %s", YoutubeLiveError, info.LiveStatus)
+	}
+
+	if info.Duration > maxDuration.Seconds() {
+		return fmt.Errorf("[%w] %.0f seconds, the limit is %s", YoutubeTooLongError, info.Duration, maxDuration)
+	}
+
+	return nil
+}
+
+// Fetches the metadata of the video and checks if it can be used in an edit.
+func PreflightYoutubeVideo(ctx context.Context, link string, maxDuration time.Duration) (*YoutubeInfo, error) {
+
+	info, err := FetchYoutubeInfo(ctx, link)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return info, info.Check(maxDuration)
+}
@@ -0,0 +1,162 @@
+package mediasync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestYoutubeInfoError(t *testing.T) {
+
+	exitErr := errors.New("exit status 1")
+
+	tests := []struct {
+		message string
+		want    error
+	}{
+		{"ERROR: [youtube] aaaaaaaaaaa: Private video. Sign in if you've been granted access to this video", YoutubePrivateError},
+		{"ERROR: [youtube] aaaaaaaaaaa: Video unavailable. This video is private", YoutubePrivateError},
+		{"ERROR: [youtube] aaaaaaaaaaa: Join this channel to get access to members-only content like this video, and other exclusive perks. This video is available to this channel's members on level: Member", YoutubePrivateError},
+		{"ERROR: [youtube] aaaaaaaaaaa: Video unavailable", YoutubeNotFoundError},
+		{"ERROR: [youtube] aaaaaaaaaaa: Video unavailable. This video has been removed by the uploader", YoutubeNotFoundError},
+		{"ERROR: [youtube] aaaaaaaaaaa: The uploader has not made this video available in your country", YoutubeNotFoundError},
+		{"ERROR: [youtube:truncated_id] aaaa: Incomplete YouTube ID aaaa", YoutubeNotFoundError},
+
+		// these are our problem (or youtube's), not the video's
+		{"ERROR: [youtube] aaaaaaaaaaa: Requested format is not available. Use --list-formats for a list of available formats", nil},
+		{"ERROR: [youtube] aaaaaaaaaaa: Sign in to confirm you're not a bot", nil},
+		{"ERROR: Unable to download API page: HTTP Error 429: Too Many Requests", nil},
+	}
+
+	for _, test := range tests {
+		err := youtubeInfoError(exitErr, test.message)
+
+		if test.want == nil {
+			if errors.Is(err, YoutubePrivateError) || errors.Is(err, YoutubeNotFoundError) || !errors.Is(err, exitErr) {
+				t.Errorf("%q: got %v, want the yt-dlp error", test.message, err)
+			}
+		} else if !errors.Is(err, test.want) {
+			t.Errorf("%q: got %v, want %v", test.message, err, test.want)
+		}
+	}
+}
+
+// puts a yt-dlp in PATH which writes a line to calls whenever it runs, and prints output
+// to stdout, or to stderr with exit status 1 if fail is set
+func fakeYtDlp(t *testing.T, output string, fail bool) (calls string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake yt-dlp is a shell script")
+	}
+
+	dir := t.TempDir()
+	calls = filepath.Join(dir, "calls")
+
+	script := "#!/bin/sh\necho >> '" + calls + "'\n"
+
+	if fail {
+		script += "echo '" + output + "' >&2\nexit 1\n"
+	} else {
+		script += "echo '" + output + "'\n"
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "yt-dlp"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	if _, err := exec.LookPath("yt-dlp"); err != nil {
+		t.Fatal(err)
+	}
+
+	return calls
+}
+
+func countCalls(t *testing.T, calls string) int {
+	content, err := os.ReadFile(calls)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return 0
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.Count(string(content), "\n")
+}
+
+func TestFetchYoutubeInfoIsCached(t *testing.T) {
+
+	calls := fakeYtDlp(t, `{"id": "cachedvideo", "title": "chart", "duration": 120}`, false)
+
+	link := "https://www.youtube.com/watch?v=cachedvideo"
+
+	var wg sync.WaitGroup
+
+	for range 8 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			info, err := FetchYoutubeInfo(context.Background(), link)
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			// callers get their own copy
+			info.Title = "changed"
+		}()
+	}
+
+	wg.Wait()
+
+	info, err := FetchYoutubeInfo(context.Background(), "https://youtu.be/cachedvideo")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Title != "chart" || info.Duration != 120 {
+		t.Errorf("got %+v", info)
+	}
+
+	// the first batch of requests may all miss the cache, but no more than the concurrency limit
+	if n := countCalls(t, calls); n < 1 || n > MAX_CONCURRENT_YOUTUBE_INFO {
+		t.Errorf("yt-dlp ran %d times", n)
+	}
+}
+
+func TestFetchYoutubeInfoCachesOnlyVideoErrors(t *testing.T) {
+
+	calls := fakeYtDlp(t, "ERROR: [youtube] removedvideo: Video unavailable", true)
+
+	for range 2 {
+		if _, err := FetchYoutubeInfo(context.Background(), "https://youtu.be/removedvideo"); !errors.Is(err, YoutubeNotFoundError) {
+			t.Fatalf("got %v", err)
+		}
+	}
+
+	if n := countCalls(t, calls); n != 1 {
+		t.Errorf("yt-dlp ran %d times for a missing video", n)
+	}
+
+	calls = fakeYtDlp(t, "ERROR: Unable to download API page: HTTP Error 429: Too Many Requests", true)
+
+	for range 2 {
+		if _, err := FetchYoutubeInfo(context.Background(), "https://youtu.be/ratelimited"); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+
+	if n := countCalls(t, calls); n != 2 {
+		t.Errorf("yt-dlp ran %d times for a transient error, it shouldn't be cached", n)
+	}
+}
@@ -0,0 +1,247 @@
+package metrics
+
+// A minimal implementation of the metric types we need, written in the prometheus text format
+// (https://prometheus.io/docs/instrumenting/exposition_formats/) by Handler.
+// Metrics register themselves when created, and are usually package variables.
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// in seconds, from quick probes to whole edits
+var DurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registryMutex sync.Mutex
+	registry      []metric
+)
+
+func register(m metric) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	registry = append(registry, m)
+}
+
+// Serves every registered metric.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		registryMutex.Lock()
+		metrics := append([]metric(nil), registry...)
+		registryMutex.Unlock()
+
+		for _, m := range metrics {
+			m.write(w)
+		}
+	})
+}
+
+// the name and labels shared by every metric type
+type family struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (f *family) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, helpEscaper.Replace(f.help), f.name, kind)
+}
+
+// series are identified by their label values joined with this, which can't appear in valid utf-8
+const labelSeparator = "\xff"
+
+// returns false if the number of values doesn't match the labels, in which case the value
+// is dropped: a wrong metric is a bug, but not one worth failing an edit for
+func (f *family) key(values []string) (string, bool) {
+	if len(values) != len(f.labels) {
+		slog.Error("metric observed with the wrong number of labels", "metric", f.name, "labels", f.labels, "values", values)
+		return "", false
+	}
+
+	return strings.Join(values, labelSeparator), true
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// formats the labels of a series, with extra appended (e.g the le label of histogram buckets)
+func (f *family) labelPairs(key string, extra ...string) string {
+	var pairs []string
+
+	if len(f.labels) > 0 {
+		for i, value := range strings.Split(key, labelSeparator) {
+			pairs = append(pairs, f.labels[i]+`="`+labelEscaper.Replace(value)+`"`)
+		}
+	}
+
+	pairs = append(pairs, extra...)
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys[V any](series map[string]V) []string {
+	keys := make([]string, 0, len(series))
+
+	for key := range series {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type Counter struct {
+	family
+
+	mutex  sync.Mutex
+	series map[string]float64
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	counter := &Counter{family: family{name, help, labels}, series: make(map[string]float64)}
+
+	// a counter without labels has a single series, which is shown before it is incremented
+	if len(labels) == 0 {
+		counter.series[""] = 0
+	}
+
+	register(counter)
+	return counter
+}
+
+// Increments the series with the given label values, in the order the labels were given to NewCounter.
+func (c *Counter) Inc(values ...string) {
+	key, ok := c.key(values)
+
+	if !ok {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.series[key]++
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.header(w, "counter")
+
+	for _, key := range sortedKeys(c.series) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(key), formatFloat(c.series[key]))
+	}
+}
+
+type Histogram struct {
+	family
+	buckets []float64
+
+	mutex  sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // by bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	histogram := &Histogram{family: family{name, help, labels}, buckets: buckets, series: make(map[string]*histogramSeries)}
+	register(histogram)
+	return histogram
+}
+
+func (h *Histogram) Observe(value float64, values ...string) {
+	key, ok := h.key(values)
+
+	if !ok {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	series, ok := h.series[key]
+
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		series.counts[i]++
+	}
+
+	series.count++
+	series.sum += value
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.header(w, "histogram")
+
+	for _, key := range sortedKeys(h.series) {
+		series := h.series[key]
+
+		var cumulative uint64
+
+		for i, bound := range h.buckets {
+			cumulative += series.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, `le="`+formatFloat(bound)+`"`), cumulative)
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, `le="+Inf"`), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(key), formatFloat(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(key), series.count)
+	}
+}
+
+// A gauge whose value is read when the metrics are served.
+type GaugeFunc struct {
+	family
+	value func() float64
+}
+
+func NewGaugeFunc(name string, help string, value func() float64) *GaugeFunc {
+	gauge := &GaugeFunc{family: family{name: name, help: help}, value: value}
+	register(gauge)
+	return gauge
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.header(w, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value()))
+}
@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func written(m metric) string {
+	var buffer bytes.Buffer
+	m.write(&buffer)
+	return buffer.String()
+}
+
+func TestCounterExposition(t *testing.T) {
+
+	counter := NewCounter("test_requests_total", "Requests, by path\nand \\ method.", "path", "method")
+
+	counter.Inc("/b", "GET")
+	counter.Inc("/a", "POST")
+	counter.Inc("/b", "GET")
+	counter.Inc(`quote " backslash \ newline`+"\n", "GET")
+
+	expected := `# HELP test_requests_total Requests, by path\nand \\ method.
+# TYPE test_requests_total counter
+test_requests_total{path="/a",method="POST"} 1
+test_requests_total{path="/b",method="GET"} 2
+test_requests_total{path="quote \" backslash \\ newline\n",method="GET"} 1
+`
+
+	if got := written(counter); got != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestCounterWithoutLabels(t *testing.T) {
+
+	counter := NewCounter("test_evictions_total", "Evictions.")
+
+	expected := "# HELP test_evictions_total Evictions.\n# TYPE test_evictions_total counter\ntest_evictions_total 0\n"
+
+	if got := written(counter); got != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+
+	counter.Inc()
+	counter.Inc()
+
+	if got := written(counter); !strings.HasSuffix(got, "\ntest_evictions_total 2\n") {
+		t.Errorf("expected the counter to be 2, got\n%s", got)
+	}
+}
+
+func TestHistogramExposition(t *testing.T) {
+
+	histogram := NewHistogram("test_duration_seconds", "Durations.", []float64{0.5, 1, 2.5}, "stage")
+
+	// a value equal to a bound goes in its bucket
+	for _, value := range []float64{0.1, 0.5, 2, 3} {
+		histogram.Observe(value, "mux")
+	}
+
+	histogram.Observe(1, "extract")
+
+	expected := `# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{stage="extract",le="0.5"} 0
+test_duration_seconds_bucket{stage="extract",le="1"} 1
+test_duration_seconds_bucket{stage="extract",le="2.5"} 1
+test_duration_seconds_bucket{stage="extract",le="+Inf"} 1
+test_duration_seconds_sum{stage="extract"} 1
+test_duration_seconds_count{stage="extract"} 1
+test_duration_seconds_bucket{stage="mux",le="0.5"} 2
+test_duration_seconds_bucket{stage="mux",le="1"} 2
+test_duration_seconds_bucket{stage="mux",le="2.5"} 3
+test_duration_seconds_bucket{stage="mux",le="+Inf"} 4
+test_duration_seconds_sum{stage="mux"} 5.6
+test_duration_seconds_count{stage="mux"} 4
+`
+
+	if got := written(histogram); got != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestWrongLabelCountIsDropped(t *testing.T) {
+
+	counter := NewCounter("test_wrong_total", "Wrong.", "a", "b")
+	histogram := NewHistogram("test_wrong_seconds", "Wrong.", []float64{1}, "a")
+
+	counter.Inc("only one")
+	counter.Inc("one", "two", "three")
+	histogram.Observe(1)
+
+	if got := written(counter); strings.Count(got, "\n") != 2 {
+		t.Errorf("expected no series, got\n%s", got)
+	}
+
+	if got := written(histogram); strings.Count(got, "\n") != 2 {
+		t.Errorf("expected no series, got\n%s", got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+
+	value := 1.5
+
+	NewGaugeFunc("test_queue_pending", "Pending jobs.", func() float64 { return value })
+
+	response := httptest.NewRecorder()
+	Handler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if contentType := response.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", contentType)
+	}
+
+	body := response.Body.String()
+
+	if !strings.Contains(body, "# TYPE test_queue_pending gauge\ntest_queue_pending 1.5\n") {
+		t.Errorf("the gauge is missing from\n%s", body)
+	}
+}
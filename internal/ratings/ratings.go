@@ -0,0 +1,63 @@
+package ratings
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cosineblast/pumpsync/internal/video_store"
+)
+
+// A Rating is what a user thought about an edit result, along with how the edit went,
+// so we can find out which scores actually produce good syncs.
+type Rating struct {
+	VideoId string    `json:"video_id"`
+	Created time.Time `json:"created"`
+
+	ThumbsUp bool `json:"thumbs_up"`
+
+	// how many milliseconds the music should be moved (positive is later), if the user told us
+	OffsetCorrectionMs *int `json:"offset_correction_ms,omitempty"`
+
+	Comment string `json:"comment,omitempty"`
+
+	Match video_store.Diagnostics `json:"match"`
+}
+
+// RatingStore appends ratings to a file, one json object per line.
+type RatingStore struct {
+	mutex sync.Mutex
+	path  string
+}
+
+func NewRatingStore(path string) *RatingStore {
+	return &RatingStore{path: path}
+}
+
+func (store *RatingStore) Add(rating Rating) error {
+
+	line, err := json.Marshal(rating)
+
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	file, err := os.OpenFile(store.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(line, '\n'))
+
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,418 @@
+package video_store
+
+// FilesystemStore keeps the results in a directory, along with an index (index.json) describing them,
+// so results (and their download links) survive restarts of the server.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const indexFileName = "index.json"
+
+// the prefix of the files written by CheckWritable
+const checkFilePrefix = ".pumpsync_check_"
+
+type index struct {
+	Videos []Video `json:"videos"`
+}
+
+type FilesystemStore struct {
+	dir string
+	ttl time.Duration
+
+	mutex  sync.Mutex
+	videos map[uuid.UUID]Video
+}
+
+// Opens the store in dir (creating it if needed), where videos are kept for ttl.
+// Videos in the index which expired or whose file is gone are dropped,
+// and results in dir which aren't in the index are deleted (other files are left alone, see isStoreFile).
+func NewFilesystemStore(dir string, ttl time.Duration) (*FilesystemStore, error) {
+
+	if ttl <= 0 {
+		ttl = DEFAULT_TTL
+	}
+
+	dir, err := filepath.Abs(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	store := &FilesystemStore{
+		dir:    dir,
+		ttl:    ttl,
+		videos: make(map[uuid.UUID]Video),
+	}
+
+	if err = store.reconcile(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *FilesystemStore) reconcile() error {
+
+	content, err := os.ReadFile(filepath.Join(store.dir, indexFileName))
+
+	var saved index
+
+	if err == nil {
+		if err = json.Unmarshal(content, &saved); err != nil {
+			// the files are still removed below, since nothing references them anymore
+			slog.Warn("ignoring corrupted video store index", "err", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	now := time.Now()
+
+	for _, video := range saved.Videos {
+		if video.expired(now) || filepath.Dir(video.Path) != store.dir {
+			continue
+		}
+
+		info, err := os.Stat(video.Path)
+
+		if err != nil || info.Size() != video.Size {
+			continue
+		}
+
+		store.videos[video.Id] = video
+	}
+
+	entries, err := os.ReadDir(store.dir)
+
+	if err != nil {
+		return err
+	}
+
+	live := make(map[string]bool)
+
+	for _, video := range store.videos {
+		live[filepath.Base(video.Path)] = true
+	}
+
+	removed := 0
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !isStoreFile(entry.Name()) || live[entry.Name()] {
+			continue
+		}
+
+		if err = os.Remove(filepath.Join(store.dir, entry.Name())); err != nil {
+			slog.Warn("failed to remove orphaned result", "file", entry.Name(), "err", err)
+		} else {
+			removed++
+		}
+	}
+
+	slog.Info("video store reloaded", "videos", len(store.videos), "orphans_removed", removed)
+
+	return store.saveIndex()
+}
+
+// whether the file was written by the store: a result (<uuid>.<extension>), or a temporary
+// file of saveIndex or CheckWritable left behind by a crash. The directory may be shared
+// with other programs (e.g /tmp), so nothing else is ever removed.
+func isStoreFile(name string) bool {
+
+	if suffix, ok := strings.CutPrefix(name, indexFileName+"."); ok {
+		return isTempSuffix(suffix)
+	}
+
+	if suffix, ok := strings.CutPrefix(name, checkFilePrefix); ok {
+		return isTempSuffix(suffix)
+	}
+
+	extension := filepath.Ext(name)
+
+	if _, ok := contentTypes[extension]; !ok {
+		return false
+	}
+
+	id, err := uuid.Parse(strings.TrimSuffix(name, extension))
+
+	// uuid.Parse also takes other forms of uuids (e.g with braces), which we never write
+	return err == nil && id.String()+extension == name
+}
+
+// os.CreateTemp replaces the * in its pattern with digits
+func isTempSuffix(suffix string) bool {
+	return suffix != "" && strings.Trim(suffix, "0123456789") == ""
+}
+
+// writes the index to a temporary file first, so a crash never leaves half of it behind.
+// the store mutex must be held (or the store not shared yet)
+func (store *FilesystemStore) saveIndex() error {
+
+	saved := index{Videos: make([]Video, 0, len(store.videos))}
+
+	for _, video := range store.videos {
+		saved.Videos = append(saved.Videos, video)
+	}
+
+	content, err := json.Marshal(saved)
+
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(store.dir, indexFileName)
+
+	file, err := os.CreateTemp(store.dir, indexFileName+".*")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(content)
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+	}
+
+	return err
+}
+
+func (store *FilesystemStore) FetchVideo(ctx context.Context, id uuid.UUID) (*Video, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	video, ok := store.videos[id]
+
+	// the janitor may not have removed it yet
+	if !ok || video.expired(time.Now()) {
+		return nil, nil
+	}
+
+	return &video, nil
+}
+
+func (store *FilesystemStore) OpenVideo(ctx context.Context, video *Video) (io.ReadSeekCloser, error) {
+	return os.Open(video.Path)
+}
+
+// videos are always served by this server
+func (store *FilesystemStore) DownloadURL(video *Video, disposition string) (string, error) {
+	return "", nil
+}
+
+func (store *FilesystemStore) AddVideo(ctx context.Context, path string, metadata Metadata) (uuid.UUID, error) {
+
+	var err error
+
+	defer func() {
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	uid, err := uuid.NewRandom()
+
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	extension, contentType := videoType(path)
+
+	destination := filepath.Join(store.dir, uid.String()+extension)
+
+	err = MoveFile(path, destination)
+
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	info, err := os.Stat(destination)
+
+	if err != nil {
+		os.Remove(destination)
+		return uuid.UUID{}, err
+	}
+
+	now := time.Now()
+
+	video := Video{
+		Id:          uid,
+		Path:        destination,
+		Extension:   extension,
+		ContentType: contentType,
+		Size:        info.Size(),
+		Created:     now,
+		Expires:     now.Add(store.ttl),
+		Metadata:    metadata,
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.videos[uid] = video
+
+	if err = store.saveIndex(); err != nil {
+		delete(store.videos, uid)
+		os.Remove(destination)
+		return uuid.UUID{}, err
+	}
+
+	return uid, nil
+}
+
+func (store *FilesystemStore) Usage() (int, int64) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var size int64
+
+	for _, video := range store.videos {
+		size += video.Size
+	}
+
+	return len(store.videos), size
+}
+
+func (store *FilesystemStore) CheckWritable(ctx context.Context) error {
+	return CheckDirWritable(store.dir)
+}
+
+// Checks if files can be created in dir, without opening the store in it (which would remove
+// the results of a server using it, see NewFilesystemStore). When dir doesn't exist yet,
+// the closest directory above it is checked instead, since the store would create it.
+func CheckDirWritable(dir string) error {
+
+	dir, err := filepath.Abs(dir)
+
+	if err != nil {
+		return err
+	}
+
+	for {
+		_, err = os.Stat(dir)
+
+		if !errors.Is(err, os.ErrNotExist) || filepath.Dir(dir) == dir {
+			break
+		}
+
+		dir = filepath.Dir(dir)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(dir, checkFilePrefix+"*")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(file.Name())
+
+	if _, err = file.WriteString("ok"); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func (store *FilesystemStore) RunJanitor(ctx context.Context) {
+	ticker := time.NewTicker(JANITOR_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			store.removeExpired()
+		}
+	}
+}
+
+func (store *FilesystemStore) removeExpired() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	removed := false
+
+	for id, video := range store.videos {
+		if video.expired(now) {
+			delete(store.videos, id)
+			os.Remove(video.Path)
+			removed = true
+		}
+	}
+
+	if !removed {
+		return
+	}
+
+	if err := store.saveIndex(); err != nil {
+		slog.Error("failed to save video store index", "err", err)
+	}
+}
+
+// Like os.Rename, but also works when the paths are in different file systems,
+// e.g results are usually produced in the system temporary directory, which may be in another one than the store.
+func MoveFile(source string, destination string) error {
+	err := os.Rename(source, destination)
+
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	input, err := os.Open(source)
+
+	if err != nil {
+		return err
+	}
+
+	defer input.Close()
+
+	output, err := os.Create(destination)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(output, input)
+
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(destination)
+		return err
+	}
+
+	return os.Remove(source)
+}
@@ -0,0 +1,150 @@
+package video_store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestIsStoreFile(t *testing.T) {
+
+	id := uuid.New().String()
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{id + ".mp4", true},
+		{id + ".flac", true},
+		{"index.json.123456", true},
+		{".pumpsync_check_987", true},
+
+		{indexFileName, false},
+		{id, false},
+		{id + ".txt", false},
+		{"{" + id + "}.mp4", false},
+		{"video.mp4", false},
+		{"index.json.bak", false},
+		{".pumpsync_check_", false},
+		{"systemd-private-abc", false},
+	}
+
+	for _, test := range tests {
+		if got := isStoreFile(test.name); got != test.want {
+			t.Errorf("isStoreFile(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReconcileOnlyRemovesOrphanedResults(t *testing.T) {
+
+	dir := t.TempDir()
+
+	store, err := NewFilesystemStore(dir, time.Hour)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := filepath.Join(t.TempDir(), "result.mp4")
+
+	if err = os.WriteFile(source, []byte("video"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := store.AddVideo(context.Background(), source, Metadata{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orphans := []string{uuid.New().String() + ".mp4", "index.json.42", ".pumpsync_check_7"}
+
+	// e.g when the store is in /tmp
+	others := []string{"notes.txt", uuid.New().String(), "index.json.bak"}
+
+	for _, name := range append(append([]string{}, orphans...), others...) {
+		if err = os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a directory named like a result
+	if err = os.Mkdir(filepath.Join(dir, uuid.New().String()+".mp4"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewFilesystemStore(dir, time.Hour)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if video, err := store.FetchVideo(context.Background(), id); err != nil || video == nil {
+		t.Fatalf("the result was not kept: %v", err)
+	}
+
+	for _, name := range orphans {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", name)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the result, its index, the other files and the directory
+	if len(entries) != 2+len(others)+1 {
+		var names []string
+
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+
+		t.Errorf("unexpected files left: %v", names)
+	}
+}
+
+func TestCheckDirWritableLeavesTheStoreAlone(t *testing.T) {
+
+	dir := t.TempDir()
+
+	// not in any index, so opening the store would remove it
+	orphan := filepath.Join(dir, uuid.New().String()+".mp4")
+
+	if err := os.WriteFile(orphan, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckDirWritable(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].Name() != filepath.Base(orphan) {
+		t.Errorf("expected only the orphan to be left, got %v", entries)
+	}
+
+	// the store would create it
+	missing := filepath.Join(dir, "results", "nested")
+
+	if err := CheckDirWritable(missing); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "results")); !os.IsNotExist(err) {
+		t.Error("the check created the store directory")
+	}
+}
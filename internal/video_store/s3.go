@@ -0,0 +1,620 @@
+package video_store
+
+// S3Store keeps the results in an S3 compatible bucket (e.g AWS S3 or MinIO), so every instance
+// of the server can serve the results of the others. Each video is stored as two objects under the prefix:
+// the video itself (<id><extension>) and its metadata (<id>.json).
+// Requests are signed with AWS signature version 4, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// how long the presigned download urls work, they are only meant to be followed right away
+const PRESIGNED_URL_LIFETIME = 5 * time.Minute
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+var S3RequestError = errors.New("s3 request failed")
+
+var EmptyS3PrefixError = errors.New("the s3 prefix must not be empty, since the janitor removes every expired object with it")
+
+type S3Config struct {
+	Endpoint string // e.g https://s3.us-east-1.amazonaws.com or http://localhost:9000, buckets are addressed in the path
+	Region   string
+	Bucket   string
+	Prefix   string // of the object keys (e.g `results/`), every object with it may be removed by the janitor
+
+	AccessKey string
+	SecretKey string
+
+	// downloads are redirected to presigned urls, instead of being streamed through this server
+	Redirect bool
+
+	// the bucket has a lifecycle rule which removes expired objects, so the janitor doesn't
+	Lifecycle bool
+}
+
+type S3Store struct {
+	config   S3Config
+	endpoint *url.URL
+	ttl      time.Duration
+	client   *http.Client
+
+	// as of the last time the janitor listed the bucket
+	videos atomic.Int64
+	bytes  atomic.Int64
+}
+
+func NewS3Store(config S3Config, ttl time.Duration) (*S3Store, error) {
+
+	if ttl <= 0 {
+		ttl = DEFAULT_TTL
+	}
+
+	endpoint, err := url.Parse(strings.TrimSuffix(config.Endpoint, "/"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("expected an http or https s3 endpoint, got %q", config.Endpoint)
+	}
+
+	if config.Prefix == "" {
+		return nil, EmptyS3PrefixError
+	}
+
+	return &S3Store{config: config, endpoint: endpoint, ttl: ttl, client: http.DefaultClient}, nil
+}
+
+func (store *S3Store) AddVideo(ctx context.Context, path string, metadata Metadata) (uuid.UUID, error) {
+
+	// the file is uploaded, so it is never kept
+	defer os.Remove(path)
+
+	uid, err := uuid.NewRandom()
+
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	extension, contentType := videoType(path)
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	now := time.Now()
+
+	video := Video{
+		Id:          uid,
+		Path:        store.config.Prefix + uid.String() + extension,
+		Extension:   extension,
+		ContentType: contentType,
+		Size:        info.Size(),
+		Created:     now,
+		Expires:     now.Add(store.ttl),
+		Metadata:    metadata,
+	}
+
+	err = store.putObject(ctx, video.Path, file, video.Size, contentType)
+
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	content, err := json.Marshal(video)
+
+	if err == nil {
+		err = store.putObject(ctx, store.metadataKey(uid), bytes.NewReader(content), int64(len(content)), "application/json")
+	}
+
+	if err != nil {
+		store.deleteObject(context.WithoutCancel(ctx), video.Path)
+		return uuid.UUID{}, err
+	}
+
+	return uid, nil
+}
+
+func (store *S3Store) FetchVideo(ctx context.Context, id uuid.UUID) (*Video, error) {
+
+	response, err := store.do(ctx, http.MethodGet, store.metadataKey(id), nil, nil, 0, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if err = checkResponse(response); err != nil {
+		return nil, err
+	}
+
+	var video Video
+
+	if err = json.NewDecoder(response.Body).Decode(&video); err != nil {
+		return nil, fmt.Errorf("[%w] invalid metadata of video %s: %w", S3RequestError, id, err)
+	}
+
+	// the janitor (or the lifecycle rule) may not have removed it yet
+	if video.expired(time.Now()) {
+		return nil, nil
+	}
+
+	return &video, nil
+}
+
+func (store *S3Store) OpenVideo(ctx context.Context, video *Video) (io.ReadSeekCloser, error) {
+	return &objectReader{ctx: ctx, store: store, key: video.Path, size: video.Size}, nil
+}
+
+func (store *S3Store) DownloadURL(video *Video, disposition string) (string, error) {
+	if !store.config.Redirect {
+		return "", nil
+	}
+
+	query := url.Values{}
+	query.Set("response-content-disposition", disposition)
+	query.Set("response-content-type", video.ContentType)
+
+	lifetime := min(PRESIGNED_URL_LIFETIME, time.Until(video.Expires))
+
+	if lifetime < time.Second {
+		lifetime = time.Second
+	}
+
+	return store.presign(store.objectURL(video.Path), query, lifetime, time.Now()), nil
+}
+
+// The usage is only updated by the janitor, so it is up to JANITOR_INTERVAL old.
+func (store *S3Store) Usage() (int, int64) {
+	return int(store.videos.Load()), store.bytes.Load()
+}
+
+// Every instance writes the same object, which is fine since it is removed right away.
+func (store *S3Store) CheckWritable(ctx context.Context) error {
+
+	key := store.config.Prefix + ".pumpsync_check"
+
+	if err := store.putObject(ctx, key, strings.NewReader("ok"), 2, "text/plain"); err != nil {
+		return err
+	}
+
+	return store.deleteObject(ctx, key)
+}
+
+// Even when the bucket has a lifecycle rule, the janitor lists the bucket to know its usage.
+func (store *S3Store) RunJanitor(ctx context.Context) {
+	ticker := time.NewTicker(JANITOR_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		if err := store.sweep(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("failed to sweep the s3 bucket", "bucket", store.config.Bucket, "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+	}
+
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// Removes the expired objects (unless the bucket has a lifecycle rule) and updates the usage.
+// Other instances may be sweeping at the same time, which is fine since deletes of missing objects succeed.
+func (store *S3Store) sweep(ctx context.Context) error {
+
+	token := ""
+
+	var videos, size int64
+
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", store.config.Prefix)
+
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		response, err := store.do(ctx, http.MethodGet, "", query, nil, 0, nil)
+
+		if err != nil {
+			return err
+		}
+
+		var result listBucketResult
+
+		err = checkResponse(response)
+
+		if err == nil {
+			err = xml.NewDecoder(response.Body).Decode(&result)
+		}
+
+		response.Body.Close()
+
+		if err != nil {
+			return err
+		}
+
+		for _, object := range result.Contents {
+			// the metadata is uploaded right after the video, so both expire together
+			if time.Since(object.LastModified) <= store.ttl {
+				if strings.HasSuffix(object.Key, ".json") {
+					videos++
+				} else {
+					size += object.Size
+				}
+
+				continue
+			}
+
+			if store.config.Lifecycle {
+				continue
+			}
+
+			if err = store.deleteObject(ctx, object.Key); err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated {
+			store.videos.Store(videos)
+			store.bytes.Store(size)
+			return nil
+		}
+
+		token = result.NextContinuationToken
+	}
+}
+
+func (store *S3Store) metadataKey(id uuid.UUID) string {
+	return store.config.Prefix + id.String() + ".json"
+}
+
+func (store *S3Store) putObject(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+
+	response, err := store.do(ctx, http.MethodPut, key, nil, body, size, header)
+
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	return checkResponse(response)
+}
+
+func (store *S3Store) deleteObject(ctx context.Context, key string) error {
+
+	response, err := store.do(ctx, http.MethodDelete, key, nil, nil, 0, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	return checkResponse(response)
+}
+
+// the url of the object with key, or of the bucket if key is empty
+func (store *S3Store) objectURL(key string) *url.URL {
+	result := *store.endpoint
+
+	result.Path = result.Path + "/" + store.config.Bucket
+
+	if key != "" {
+		result.Path += "/" + key
+	}
+
+	result.RawPath = uriEncode(result.Path, false)
+
+	return &result
+}
+
+func (store *S3Store) do(ctx context.Context, method string, key string, query url.Values, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+
+	target := store.objectURL(key)
+	target.RawQuery = canonicalQuery(query)
+
+	request, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	request.ContentLength = size
+
+	for name, values := range header {
+		request.Header[name] = values
+	}
+
+	store.sign(request, unsignedPayload, time.Now())
+
+	return store.client.Do(request)
+}
+
+func checkResponse(response *http.Response) error {
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return nil
+	}
+
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+
+	return fmt.Errorf("[%w] %s %s: %s: %s", S3RequestError, response.Request.Method, response.Request.URL.Path, response.Status, message)
+}
+
+// Adds the X-Amz-Date, X-Amz-Content-Sha256 and Authorization headers to request,
+// signing the host and every header already in it.
+func (store *S3Store) sign(request *http.Request, payloadHash string, now time.Time) {
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": request.URL.Host}
+
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.Join(strings.Fields(strings.Join(values, ",")), " ")
+	}
+
+	names := make([]string, 0, len(headers))
+
+	for name := range headers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		uriEncode(request.URL.Path, false),
+		canonicalQuery(request.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope, signature := store.signature(canonicalRequest, now)
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		store.config.AccessKey, scope, signedHeaders, signature))
+}
+
+// Returns target with the query and the authentication parameters which make it usable by anyone until lifetime passes.
+func (store *S3Store) presign(target *url.URL, query url.Values, lifetime time.Duration, now time.Time) string {
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", store.config.AccessKey+"/"+store.scope(now))
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.Itoa(int(lifetime.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		uriEncode(target.Path, false),
+		canonicalQuery(query),
+		"host:" + target.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+
+	_, signature := store.signature(canonicalRequest, now)
+
+	result := *target
+	result.RawQuery = canonicalQuery(query) + "&X-Amz-Signature=" + signature
+
+	return result.String()
+}
+
+func (store *S3Store) scope(now time.Time) string {
+	return now.UTC().Format("20060102") + "/" + store.config.Region + "/s3/aws4_request"
+}
+
+// returns the credential scope and the signature of canonicalRequest
+func (store *S3Store) signature(canonicalRequest string, now time.Time) (string, string) {
+
+	scope := store.scope(now)
+	hash := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.UTC().Format("20060102T150405Z"),
+		scope,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+store.config.SecretKey), now.UTC().Format("20060102"))
+	key = hmacSHA256(key, store.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	return scope, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+
+	for key := range query {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var parts []string
+
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+
+		for _, value := range values {
+			parts = append(parts, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// percent encodes every byte except the unreserved characters (and slashes, unless encodeSlash),
+// which is stricter than what net/url does
+func uriEncode(value string, encodeSlash bool) string {
+	var result strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			result.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			result.WriteByte(c)
+		default:
+			fmt.Fprintf(&result, "%%%02X", c)
+		}
+	}
+
+	return result.String()
+}
+
+// Reads an object with ranged requests, starting a new one after each seek,
+// so http.ServeContent can serve ranges of videos without downloading them whole.
+type objectReader struct {
+	ctx   context.Context
+	store *S3Store
+	key   string
+	size  int64
+
+	offset int64
+	body   io.ReadCloser
+}
+
+func (reader *objectReader) Read(p []byte) (int, error) {
+
+	if reader.offset >= reader.size {
+		return 0, io.EOF
+	}
+
+	if reader.body == nil {
+		header := http.Header{}
+		header.Set("Range", fmt.Sprintf("bytes=%d-", reader.offset))
+
+		response, err := reader.store.do(reader.ctx, http.MethodGet, reader.key, nil, nil, 0, header)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if err = checkResponse(response); err != nil {
+			response.Body.Close()
+			return 0, err
+		}
+
+		reader.body = response.Body
+	}
+
+	n, err := reader.body.Read(p)
+	reader.offset += int64(n)
+
+	return n, err
+}
+
+func (reader *objectReader) Seek(offset int64, whence int) (int64, error) {
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += reader.offset
+	case io.SeekEnd:
+		offset += reader.size
+	}
+
+	if offset < 0 {
+		return 0, errors.New("seek to a negative offset")
+	}
+
+	if offset != reader.offset && reader.body != nil {
+		reader.body.Close()
+		reader.body = nil
+	}
+
+	reader.offset = offset
+
+	return offset, nil
+}
+
+func (reader *objectReader) Close() error {
+	if reader.body == nil {
+		return nil
+	}
+
+	return reader.body.Close()
+}
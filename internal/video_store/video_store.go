@@ -1,72 +1,127 @@
 package video_store
 
 import (
-	"github.com/google/uuid"
-	"os"
-	"sync"
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
 	"time"
+	"unicode"
+
+	"github.com/google/uuid"
 )
 
-type VideoStore struct {
-	availableVideos sync.Map
+const DEFAULT_TTL = 20 * time.Minute
+
+// how often the janitor looks for expired videos
+const JANITOR_INTERVAL = time.Minute
+
+// the content types of the results we produce, by extension
+var contentTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4a":  "audio/mp4",
+	".flac": "audio/flac",
+	".wav":  "audio/wav",
 }
 
-func NewVideoStore() VideoStore {
-	return VideoStore{}
+// Where the results of the edits are kept until they expire,
+// either in a local directory (FilesystemStore) or in an S3 compatible bucket (S3Store).
+type VideoStore interface {
+	// Moves the file in the given path to the store, keeping its extension.
+	// The file is removed even if it can't be stored.
+	AddVideo(ctx context.Context, path string, metadata Metadata) (uuid.UUID, error)
+
+	// Returns nil (and no error) if there is no such video, or if it expired.
+	FetchVideo(ctx context.Context, id uuid.UUID) (*Video, error)
+
+	OpenVideo(ctx context.Context, video *Video) (io.ReadSeekCloser, error)
+
+	// A url from which the video can be downloaded without going through this server,
+	// empty if the store doesn't have one. The given Content-Disposition is used in its response.
+	DownloadURL(video *Video, disposition string) (string, error)
+
+	// Removes the expired videos every JANITOR_INTERVAL, until ctx is done.
+	RunJanitor(ctx context.Context)
+
+	// How many videos the store has, and their size in bytes.
+	Usage() (int, int64)
+
+	// Checks if results can be added to the store, by writing and removing a small file.
+	CheckWritable(ctx context.Context) error
 }
 
-func (store *VideoStore) FetchVideo(id uuid.UUID) *string {
-	value, ok := store.availableVideos.Load(id)
+type Video struct {
+	Id          uuid.UUID `json:"id"`
+	Path        string    `json:"path"`      // of the file in FilesystemStore, the object key in S3Store
+	Extension   string    `json:"extension"` // with the leading dot, e.g `.mp4`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
 
-	if !ok {
-		return nil
-	}
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
 
-	result := new(string)
-	*result = value.(string)
-	return result
+	Metadata
 }
 
-// Moves the file in the given file to the video store
-// the file will be automatically removed from the store after 20 minutes.
-func (store *VideoStore) AddVideo(path string) (uuid.UUID, error) {
+// what is known about the video besides its file
+type Metadata struct {
+	Title    string  `json:"title"`    // of the chart video, empty if unknown
+	Duration float64 `json:"duration"` // in seconds, 0 if unknown
 
-	var err error
+	Diagnostics Diagnostics `json:"diagnostics"`
+}
 
-	defer func() {
-		if err != nil {
-			os.Remove(path)
-		}
-	}()
+// how the edit that produced the video went, kept so users can rate the result
+type Diagnostics struct {
+	Delimiter  string  `json:"delimiter"` // identifier of the matched game delimiter, "none" if none matched
+	StartScore float64 `json:"start_score"`
+	EndScore   float64 `json:"end_score"`
+	Score      float64 `json:"score"`  // of the music in the gameplay video
+	Offset     float64 `json:"offset"` // where the music starts in the gameplay video, in seconds
+}
+
+// the extension and content type of a video stored from path, results with unknown extensions are taken as mp4
+func videoType(path string) (string, string) {
+	extension := filepath.Ext(path)
 
-	uid, err := uuid.NewRandom()
+	contentType, ok := contentTypes[extension]
 
-	if err != nil {
-		return uuid.UUID{}, err
+	if !ok {
+		extension = ".mp4"
+		contentType = contentTypes[extension]
 	}
 
-	file, err := os.CreateTemp("", "pumsync_result_*.mp4")
+	return extension, contentType
+}
 
-	if err != nil {
-		return uuid.UUID{}, err
-	}
+func (video *Video) expired(now time.Time) bool {
+	return now.After(video.Expires)
+}
 
-	file.Close()
+const maxFileNameLength = 100
 
-	err = os.Rename(path, file.Name())
+// The name the video is downloaded with, the title of the chart without the characters
+// file systems don't like, or `result` if there is no title.
+func (video *Video) FileName() string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(" -_.,()[]&'!", r) {
+			return r
+		}
 
-	if err != nil {
-		return uuid.UUID{}, err
-	}
+		return ' '
+	}, video.Title)
 
-	store.availableVideos.Store(uid, file.Name())
+	name = strings.Join(strings.Fields(name), " ")
 
-	go func() {
-		time.Sleep(time.Duration(20 * time.Minute))
+	if runes := []rune(name); len(runes) > maxFileNameLength {
+		name = strings.TrimSpace(string(runes[:maxFileNameLength]))
+	}
+
+	name = strings.Trim(name, ".")
 
-		store.availableVideos.Delete(uid)
-		os.Remove(file.Name())
-	}()
+	if name == "" {
+		name = "result"
+	}
 
-	return uid, nil
+	return name + video.Extension
 }
@@ -0,0 +1,201 @@
+package work_queue
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+var QueueFullError = errors.New("work queue is full")
+
+// A WorkQueue runs submitted tasks in order with a fixed amount of workers,
+// and keeps track of the position of each task waiting for a worker.
+type WorkQueue struct {
+	mutex sync.Mutex
+	ready *sync.Cond
+	idle  *sync.Cond
+
+	pending    []*Ticket
+	active     int
+	maxPending int
+}
+
+// A Ticket represents a task submitted to a WorkQueue.
+type Ticket struct {
+	task func()
+
+	positions chan int
+	position  atomic.Int64 // the last one sent to positions
+	started   chan struct{}
+	done      chan struct{}
+}
+
+// Creates a queue that runs at most `workers` tasks at the same time,
+// and refuses new tasks when `maxPending` tasks are already waiting.
+func NewWorkQueue(workers int, maxPending int) *WorkQueue {
+	queue := &WorkQueue{maxPending: maxPending}
+	queue.ready = sync.NewCond(&queue.mutex)
+	queue.idle = sync.NewCond(&queue.mutex)
+
+	for i := 0; i < workers; i++ {
+		go queue.work()
+	}
+
+	return queue
+}
+
+// Adds a task to the end of the queue.
+func (q *WorkQueue) Submit(task func()) (*Ticket, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.pending) >= q.maxPending {
+		return nil, QueueFullError
+	}
+
+	ticket := &Ticket{
+		task:      task,
+		positions: make(chan int, 1),
+		started:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	q.pending = append(q.pending, ticket)
+	ticket.setPosition(len(q.pending))
+
+	q.ready.Signal()
+
+	return ticket, nil
+}
+
+// Removes the ticket from the queue if no worker picked it up yet.
+// Returns false if the task already started.
+func (q *WorkQueue) Cancel(ticket *Ticket) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for i, pending := range q.pending {
+		if pending == ticket {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			q.updatePositions()
+			close(ticket.done)
+			q.notifyIfIdle()
+			return true
+		}
+	}
+
+	return false
+}
+
+// Blocks until there are no pending or running tasks.
+func (q *WorkQueue) Wait() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for len(q.pending) > 0 || q.active > 0 {
+		q.idle.Wait()
+	}
+}
+
+// must be called with the mutex held
+func (q *WorkQueue) notifyIfIdle() {
+	if len(q.pending) == 0 && q.active == 0 {
+		q.idle.Broadcast()
+	}
+}
+
+// Number of tasks waiting for a worker.
+func (q *WorkQueue) Pending() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.pending)
+}
+
+// Number of tasks currently being run.
+func (q *WorkQueue) Active() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.active
+}
+
+func (q *WorkQueue) work() {
+	for {
+		q.mutex.Lock()
+
+		for len(q.pending) == 0 {
+			q.ready.Wait()
+		}
+
+		ticket := q.pending[0]
+		q.pending = q.pending[1:]
+		q.active++
+		q.updatePositions()
+
+		q.mutex.Unlock()
+
+		close(ticket.started)
+
+		q.run(ticket)
+
+		q.mutex.Lock()
+		q.active--
+		q.notifyIfIdle()
+		q.mutex.Unlock()
+	}
+}
+
+func (q *WorkQueue) run(ticket *Ticket) {
+	defer close(ticket.done)
+
+	defer func() {
+		if err := recover(); err != nil {
+			slog.Error("work queue task panicked", "err", err)
+		}
+	}()
+
+	ticket.task()
+}
+
+// must be called with the mutex held
+func (q *WorkQueue) updatePositions() {
+	for i, ticket := range q.pending {
+		ticket.setPosition(i + 1)
+	}
+}
+
+// only keeps the latest position in the channel, so a slow reader
+// never blocks the queue
+func (t *Ticket) setPosition(position int) {
+	t.position.Store(int64(position))
+
+	select {
+	case <-t.positions:
+	default:
+	}
+
+	t.positions <- position
+}
+
+// Receives the position of the ticket in the queue whenever it changes,
+// starting from 1 (the next ticket to be picked up).
+func (t *Ticket) Positions() <-chan int {
+	return t.positions
+}
+
+// The current position of the ticket in the queue, or the last one it had before a worker picked it up.
+func (t *Ticket) Position() int {
+	return int(t.position.Load())
+}
+
+// Closed when a worker starts running the task.
+func (t *Ticket) Started() <-chan struct{} {
+	return t.started
+}
+
+// Closed when the task finishes running, or is cancelled before starting.
+func (t *Ticket) Done() <-chan struct{} {
+	return t.done
+}
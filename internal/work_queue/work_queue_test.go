@@ -0,0 +1,217 @@
+package work_queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+// submits a task which runs until release is closed
+func submitBlocking(t *testing.T, queue *WorkQueue, release <-chan struct{}) *Ticket {
+	t.Helper()
+
+	ticket, err := queue.Submit(func() { <-release })
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ticket
+}
+
+func TestPositions(t *testing.T) {
+
+	queue := NewWorkQueue(1, 8)
+
+	releases := make([]chan struct{}, 4)
+	tickets := make([]*Ticket, 4)
+
+	for i := range tickets {
+		releases[i] = make(chan struct{})
+		tickets[i] = submitBlocking(t, queue, releases[i])
+	}
+
+	waitFor(t, tickets[0].Started(), "the first task")
+
+	for i, ticket := range tickets[1:] {
+		if got := ticket.Position(); got != i+1 {
+			t.Errorf("ticket %d is at position %d, want %d", i+1, got, i+1)
+		}
+	}
+
+	close(releases[0])
+	waitFor(t, tickets[1].Started(), "the second task")
+
+	if got := tickets[2].Position(); got != 1 {
+		t.Errorf("the third ticket is at position %d, want 1", got)
+	}
+
+	// only the latest position is kept
+	if got := <-tickets[3].Positions(); got != 2 {
+		t.Errorf("the last ticket received position %d, want 2", got)
+	}
+
+	if queue.Pending() != 2 || queue.Active() != 1 {
+		t.Errorf("got %d pending and %d active tasks", queue.Pending(), queue.Active())
+	}
+
+	for _, release := range releases[1:] {
+		close(release)
+	}
+
+	queue.Wait()
+}
+
+func TestCancel(t *testing.T) {
+
+	queue := NewWorkQueue(1, 8)
+
+	release := make(chan struct{})
+	running := submitBlocking(t, queue, release)
+
+	waitFor(t, running.Started(), "the first task")
+
+	ran := make(chan struct{})
+
+	cancelled, err := queue.Submit(func() { close(ran) })
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := submitBlocking(t, queue, release)
+
+	if !queue.Cancel(cancelled) {
+		t.Fatal("a pending task couldn't be cancelled")
+	}
+
+	waitFor(t, cancelled.Done(), "the cancelled ticket to be done")
+
+	if got := last.Position(); got != 1 {
+		t.Errorf("the ticket after the cancelled one is at position %d, want 1", got)
+	}
+
+	if queue.Cancel(running) {
+		t.Error("a running task was cancelled")
+	}
+
+	close(release)
+	queue.Wait()
+
+	select {
+	case <-ran:
+		t.Error("a cancelled task ran")
+	default:
+	}
+
+	select {
+	case <-cancelled.Started():
+		t.Error("a cancelled ticket started")
+	default:
+	}
+
+	if queue.Cancel(last) {
+		t.Error("a finished task was cancelled")
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+
+	queue := NewWorkQueue(1, 2)
+
+	release := make(chan struct{})
+	running := submitBlocking(t, queue, release)
+
+	waitFor(t, running.Started(), "the first task")
+
+	// the running task doesn't take a place in the queue
+	submitBlocking(t, queue, release)
+	waiting := submitBlocking(t, queue, release)
+
+	if _, err := queue.Submit(func() {}); !errors.Is(err, QueueFullError) {
+		t.Fatalf("got %v, want %v", err, QueueFullError)
+	}
+
+	queue.Cancel(waiting)
+
+	if _, err := queue.Submit(func() {}); err != nil {
+		t.Fatalf("a task was refused after a place was freed: %v", err)
+	}
+
+	close(release)
+	queue.Wait()
+}
+
+func TestWaitForActiveTasks(t *testing.T) {
+
+	queue := NewWorkQueue(2, 8)
+
+	release := make(chan struct{})
+
+	tickets := []*Ticket{submitBlocking(t, queue, release), submitBlocking(t, queue, release)}
+
+	for _, ticket := range tickets {
+		waitFor(t, ticket.Started(), "the tasks to start")
+	}
+
+	// no task is pending, but both are still running
+	waited := make(chan struct{})
+
+	go func() {
+		queue.Wait()
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+		t.Fatal("Wait returned while tasks were running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	waitFor(t, waited, "Wait to return")
+
+	for _, ticket := range tickets {
+		select {
+		case <-ticket.Done():
+		default:
+			t.Error("Wait returned before a task was done")
+		}
+	}
+
+	if queue.Active() != 0 {
+		t.Errorf("%d tasks are still active", queue.Active())
+	}
+}
+
+func TestPanickingTask(t *testing.T) {
+
+	queue := NewWorkQueue(1, 8)
+
+	ticket, err := queue.Submit(func() { panic("oops") })
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, ticket.Done(), "the panicking task")
+
+	// the worker keeps running
+	next, err := queue.Submit(func() {})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, next.Done(), "the task after the panic")
+}
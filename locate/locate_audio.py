@@ -11,9 +11,7 @@ import json
 
 import fire
 
-SUPPORTED_SAMPLE_RATE = 48_000
-
-def locate_audio(haystack, needle):
+def locate_audio(haystack, needle, sample_rate):
     """
     Tries to find the best position for the audio `needle` in `haystack`.
     Returns (start_offset, confidence)
@@ -25,7 +23,7 @@ def locate_audio(haystack, needle):
 
     # our heuristic is to find the lowest point of correlation then
     # find the highest point near that one.
-    highest_point = lowest_point + np.argmax(correlation[lowest_point:int(lowest_point+SUPPORTED_SAMPLE_RATE * 0.1)])
+    highest_point = lowest_point + np.argmax(correlation[lowest_point:int(lowest_point+sample_rate * 0.1)])
 
     audio_start = highest_point - len(needle) + 1
 
@@ -44,9 +42,7 @@ def locate_audio(haystack, needle):
 def _get_audio(path):
     sample_rate, data = scipy.io.wavfile.read(path)
 
-    assert sample_rate == SUPPORTED_SAMPLE_RATE
-
-    return _make_stereo(data.astype('float64'))
+    return sample_rate, _make_stereo(data.astype('float64'))
 
 def _make_stereo(data):
     if len(data.shape) == 2 and data.shape[1] == 2:
@@ -59,7 +55,7 @@ def main(haystack_path: str, needle_path: str):
     """
     Tries to locate the position of an audio file inside another one.
 
-    haystack_path and needle_path must be strings pointing to the path of .wav files with a sample rate of 48k.
+    haystack_path and needle_path must be strings pointing to the path of .wav files with the same sample rate.
 
     This scripts emits in stdout a json dictionary with three keys:
     `offset`: a floating point value indicating the location of the `needle` file in the `haystack` file, in seconds
@@ -67,14 +63,16 @@ def main(haystack_path: str, needle_path: str):
     `score`: a floating point number that represents the confidence of this script with the given input.
     """
 
-    haystack = _get_audio(haystack_path)
+    sample_rate, haystack = _get_audio(haystack_path)
+
+    needle_sample_rate, needle = _get_audio(needle_path)
 
-    needle = _get_audio(needle_path)
+    assert sample_rate == needle_sample_rate, "Files have non matching sample rates"
 
-    start, score = locate_audio(haystack, needle)
+    start, score = locate_audio(haystack, needle, sample_rate)
 
     print(json.dumps(
-        {'offset': start / SUPPORTED_SAMPLE_RATE,
+        {'offset': start / sample_rate,
          'score': score }))
 
 if __name__ == '__main__':
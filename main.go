@@ -1,72 +1,96 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
+	"github.com/urfave/cli/v3"
 
-	"github.com/cosineblast/pumpsync/internal/handle"
+	"github.com/cosineblast/pumpsync/internal/config"
+	"github.com/cosineblast/pumpsync/internal/mediasync"
 	"github.com/cosineblast/pumpsync/internal/video_store"
-
-	"github.com/joho/godotenv"
 )
 
 func main() {
-    err := godotenv.Load()
-
-    if err != nil && !errors.Is(err, os.ErrNotExist) {
-        slog.Error("Error loading .env file", "err", err)
-        return
-    }
-
-    e := setupServer()
-
-    startServer(e)
+	cmd := &cli.Command{
+		Name:  "pumpsync",
+		Usage: "automatically edit Pump it Up gameplay videos",
+		// running without a subcommand starts the server, like older versions did
+		DefaultCommand: "serve",
+		// settings shared by every command, see the config package
+		Flags: config.Flags(),
+		Commands: []*cli.Command{
+			serveCommand(),
+			editCommand(),
+			locateCommand(),
+			focusCommand(),
+			doctorCommand(),
+		},
+	}
+
+	// commands stop what they are doing (and kill the programs they are running)
+	// once they receive one of these signals
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := cmd.Run(ctx, os.Args)
+
+	if err != nil {
+		slog.Error("command failed", "err", err)
+		stop()
+		os.Exit(1)
+	}
 }
 
-func setupServer() *echo.Echo{
-	e := echo.New()
+// loads the configuration of the command, and applies the settings which are global
+func loadConfig(cmd *cli.Command) (*config.Config, error) {
+	cfg, err := config.Load(cmd)
 
-	e.Use(middleware.Logger())
-	e.Use(middleware.Recover())
+	if err != nil {
+		return nil, err
+	}
 
-	store := video_store.NewVideoStore()
+	level := slog.LevelInfo
 
-	e.GET("/api/edit", func(c echo.Context) error { return handle.HandleEditRequest(&store, c) })
+	if cfg.Debug {
+		level = slog.LevelDebug
+	}
 
-	e.GET("/api/video/:id", func(c echo.Context) error { return handle.HandleVideoDownloadRequest(&store, c) })
+	handlerOptions := &slog.HandlerOptions{Level: level}
 
-    startServer(e)
+	if cfg.LogFormat == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, handlerOptions)))
+	} else {
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, handlerOptions)))
+	}
 
-    return e
+	return cfg, nil
 }
 
-func startServer(e *echo.Echo) {
-    host := os.Getenv("PUMPSYNC_HOST")
-
-    port := os.Getenv("PUMPSYNC_PORT")
-
-    if port == "" {
-        port = "8000"
-    }
-
-    address := host + ":" + port
+func loadDelimiters(cfg *config.Config) (*mediasync.Delimiters, error) {
+	return mediasync.LoadDelimiters(cfg.Delimiters)
+}
 
-    useTLS := os.Getenv("PUMPSYNC_USE_TLS")
+func newLocator(cfg *config.Config) (mediasync.Locator, error) {
+	return mediasync.NewLocator(cfg.Locator, cfg.LocatorPath)
+}
 
-    var err error
+// returns nil if the cache is disabled
+func newYoutubeCache(cfg *config.Config) (*mediasync.YoutubeCache, error) {
+	if cfg.YoutubeCacheDir == "" {
+		return nil, nil
+	}
 
-    if useTLS == "1" {
-        certificate := os.Getenv("PUMPSYNC_TLS_CERT")
-        key := os.Getenv("PUMPSYNC_TLS_KEY")
+	return mediasync.NewYoutubeCache(cfg.YoutubeCacheDir, cfg.YoutubeCacheBytes)
+}
 
-        err = e.StartTLS(address, certificate, key)
-    } else {
-        err = e.Start(address)
-    }
+func newVideoStore(cfg *config.Config) (video_store.VideoStore, error) {
+	if cfg.Store == "s3" {
+		return video_store.NewS3Store(cfg.S3, cfg.ResultTTL)
+	}
 
-    e.Logger.Fatal(err)
+	return video_store.NewFilesystemStore(cfg.StoreDir, cfg.ResultTTL)
 }
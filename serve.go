@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/urfave/cli/v3"
+
+	"github.com/cosineblast/pumpsync/internal/config"
+	"github.com/cosineblast/pumpsync/internal/handle"
+	"github.com/cosineblast/pumpsync/internal/health"
+	"github.com/cosineblast/pumpsync/internal/links"
+	"github.com/cosineblast/pumpsync/internal/mediasync"
+	"github.com/cosineblast/pumpsync/internal/metrics"
+	"github.com/cosineblast/pumpsync/internal/ratings"
+	"github.com/cosineblast/pumpsync/internal/video_store"
+	"github.com/cosineblast/pumpsync/internal/work_queue"
+)
+
+func serveCommand() *cli.Command {
+	return &cli.Command{
+		Name:   "serve",
+		Usage:  "start the pumpsync web server",
+		Action: runServe,
+	}
+}
+
+func runServe(ctx context.Context, cmd *cli.Command) error {
+	cfg, err := loadConfig(cmd)
+
+	if err != nil {
+		return err
+	}
+
+	locator, err := newLocator(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	delimiters, err := loadDelimiters(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	cache, err := newYoutubeCache(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	store, err := newVideoStore(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	go store.RunJanitor(ctx)
+
+	if len(cfg.LinkKeys) == 0 {
+		slog.Warn("no link keys were configured, download links will stop working when the server restarts")
+	}
+
+	if cfg.S3.Redirect && cfg.LinkMaxDownloads > 0 {
+		slog.Warn("download links have a download limit, so they are streamed instead of redirected to s3")
+	}
+
+	signer, err := links.NewSigner(cfg.LinkKeys, cfg.LinkMaxDownloads)
+
+	if err != nil {
+		return err
+	}
+
+	// the server starts anyway, as most checks can be fixed without restarting it (e.g by installing a program),
+	// and it is reported as not ready until they pass
+	checker := health.NewChecker(cfg, store.CheckWritable)
+	logFailedChecks(checker.Run(ctx))
+
+	queue := work_queue.NewWorkQueue(cfg.Workers, cfg.MaxQueued)
+
+	options := mediasync.Options{
+		Locator:      locator,
+		Delimiters:   delimiters,
+		FocusWorkers: cfg.FocusWorkers,
+		MinimumScore: cfg.MinimumScore,
+		Cache:        cache,
+		Timeout:      cfg.JobTimeout,
+	}
+
+	e := setupServer(ctx, cfg, store, signer, checker, queue, options)
+
+	// every request context derives from ctx, so running edits
+	// are cancelled when the server is asked to stop
+	e.Server.BaseContext = func(net.Listener) context.Context { return ctx }
+
+	serverErr := make(chan error, 1)
+
+	go func() {
+		serverErr <- startServer(e, cfg)
+	}()
+
+	select {
+	case err = <-serverErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = e.Shutdown(shutdownCtx)
+
+	// websocket connections are not tracked by the http server,
+	// so we wait for their jobs to be cancelled and cleaned up here
+	queue.Wait()
+
+	return err
+}
+
+// logs every request with slog, so they are in the same format as the other logs.
+// only the path is logged, as the query of download links has their signature
+func requestLogger() echo.MiddlewareFunc {
+	return middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		LogMethod:   true,
+		LogURIPath:  true,
+		LogStatus:   true,
+		LogLatency:  true,
+		LogRemoteIP: true,
+		LogError:    true,
+		HandleError: true,
+		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			attributes := []any{"method", v.Method, "path", v.URIPath, "status", v.Status, "latency", v.Latency, "remote_ip", v.RemoteIP}
+
+			if v.Error != nil {
+				attributes = append(attributes, "err", v.Error)
+			}
+
+			slog.Info("request", attributes...)
+
+			return nil
+		},
+	})
+}
+
+func setupServer(ctx context.Context, cfg *config.Config, store video_store.VideoStore, signer *links.Signer, checker *health.Checker, queue *work_queue.WorkQueue, options mediasync.Options) *echo.Echo {
+	e := echo.New()
+
+	e.Use(requestLogger())
+	e.Use(middleware.Recover())
+
+	origins := handle.NewOrigins(cfg.AllowedOrigins)
+
+	e.Use(origins.Middleware())
+
+	jobs := handle.NewJobs(ctx, cfg, store, signer, queue, options)
+
+	e.GET("/api/edit", func(c echo.Context) error { return handle.HandleEditRequest(jobs, origins, c) })
+
+	// the uploaded video, plus some room for the other form fields
+	bodyLimit := fmt.Sprintf("%dK", cfg.MaxUploadBytes/1024+10*1024)
+
+	e.POST("/api/jobs", func(c echo.Context) error { return handle.HandleCreateJobRequest(jobs, c) }, middleware.BodyLimit(bodyLimit))
+
+	e.GET("/api/jobs/:id", func(c echo.Context) error { return handle.HandleJobStatusRequest(jobs, c) })
+
+	e.GET("/api/jobs/:id/events", func(c echo.Context) error { return handle.HandleJobEventsRequest(jobs, c) })
+
+	e.GET("/api/youtube/:id/info", func(c echo.Context) error { return handle.HandleYoutubeInfoRequest(cfg, c) })
+
+	e.GET("/api/video/:id", func(c echo.Context) error { return handle.HandleVideoDownloadRequest(store, signer, c) })
+
+	e.GET("/api/video/:id/info", func(c echo.Context) error { return handle.HandleVideoInfoRequest(store, signer, c) })
+
+	ratingStore := ratings.NewRatingStore(cfg.RatingsFile)
+
+	e.POST("/api/video/:id/rating", func(c echo.Context) error { return handle.HandleRatingRequest(store, signer, ratingStore, c) })
+
+	e.GET("/api/status", func(c echo.Context) error { return handle.HandleStatusRequest(cfg, checker, queue, c) })
+
+	e.GET("/healthz", handle.HandleHealthRequest)
+
+	e.GET("/readyz", func(c echo.Context) error { return handle.HandleReadyRequest(checker, c) })
+
+	registerGauges(store, queue, options.Cache)
+
+	e.GET("/metrics", echo.WrapHandler(metrics.Handler()))
+
+	return e
+}
+
+func logFailedChecks(report health.Report) {
+	for _, check := range report.Checks {
+		if !check.Ok {
+			slog.Error("dependency check failed, edits will fail until it is fixed", "check", check.Name, "err", check.Detail)
+		}
+	}
+}
+
+func registerGauges(store video_store.VideoStore, queue *work_queue.WorkQueue, cache *mediasync.YoutubeCache) {
+	metrics.NewGaugeFunc("pumpsync_queue_pending", "Edit jobs waiting for a worker.", func() float64 {
+		return float64(queue.Pending())
+	})
+
+	metrics.NewGaugeFunc("pumpsync_jobs_active", "Edit jobs being run.", func() float64 {
+		return float64(queue.Active())
+	})
+
+	metrics.NewGaugeFunc("pumpsync_store_videos", "Results in the video store.", func() float64 {
+		videos, _ := store.Usage()
+		return float64(videos)
+	})
+
+	metrics.NewGaugeFunc("pumpsync_store_bytes", "Size of the results in the video store.", func() float64 {
+		_, size := store.Usage()
+		return float64(size)
+	})
+
+	if cache == nil {
+		return
+	}
+
+	metrics.NewGaugeFunc("pumpsync_youtube_cache_videos", "Videos in the youtube cache.", func() float64 {
+		return float64(cache.Stats().Entries)
+	})
+
+	metrics.NewGaugeFunc("pumpsync_youtube_cache_bytes", "Size of the videos in the youtube cache.", func() float64 {
+		return float64(cache.Stats().Bytes)
+	})
+}
+
+func startServer(e *echo.Echo, cfg *config.Config) error {
+	address := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+
+	// json logs are read by programs, which don't expect the banner
+	if cfg.LogFormat == "json" {
+		e.HideBanner = true
+		e.HidePort = true
+		slog.Info("http server starting", "address", address, "tls", cfg.UseTLS)
+	}
+
+	var err error
+
+	if cfg.UseTLS {
+		err = e.StartTLS(address, cfg.TLSCert, cfg.TLSKey)
+	} else {
+		err = e.Start(address)
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}